@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// maxMeanAblationDocs caps how many training docs are averaged for "mean" mode.
+const maxMeanAblationDocs = 200
+
+// ablationEdits validates ablations and turns them into forward-pass edits
+// (see forwardHooks) that replace a head's, block's or neurons' output with
+// zeros or its usual average on every position. Model.State is never
+// modified.
+//
+// docs are only read for "mean" mode, to average each component's output.
+func ablationEdits(im *InferenceModel, ablations []Ablation, docs []string) (map[hookSite]siteEdit, error) {
+	cfg := im.Config
+	hidden := len(im.Weights["layer0.mlp_fc1"])
+	var means map[hookSite][]float64
+
+	edits := make(map[hookSite]siteEdit)
+	for _, a := range ablations {
+		if a.Layer < 0 || a.Layer >= cfg.NLayer {
+			return nil, fmt.Errorf("ablation layer %d out of range [0, %d)", a.Layer, cfg.NLayer)
+		}
+		var site hookSite
+		var index []int
+		switch a.Component {
+		case "head":
+			if a.Head < 0 || a.Head >= cfg.NHead {
+				return nil, fmt.Errorf("ablation head %d out of range [0, %d)", a.Head, cfg.NHead)
+			}
+			site = hookSite{Name: "head", Layer: a.Layer, Head: a.Head}
+		case "attn":
+			site = hookSite{Name: "attn_out", Layer: a.Layer}
+		case "mlp":
+			site = hookSite{Name: "mlp_out", Layer: a.Layer}
+		case "neurons":
+			if len(a.Neurons) == 0 {
+				return nil, fmt.Errorf("neurons ablation needs at least one neuron")
+			}
+			for _, n := range a.Neurons {
+				if n < 0 || n >= hidden {
+					return nil, fmt.Errorf("ablation neuron %d out of range [0, %d)", n, hidden)
+				}
+			}
+			site = hookSite{Name: "mlp_relu", Layer: a.Layer}
+			index = a.Neurons
+		default:
+			return nil, fmt.Errorf("unknown ablation component %q (use head, attn, mlp or neurons)", a.Component)
+		}
+
+		size := cfg.NEmpd
+		switch site.Name {
+		case "head":
+			size = cfg.headDim()
+		case "mlp_relu":
+			size = hidden
+		}
+		full := make([]float64, size)
+		switch a.Mode {
+		case "", "zero":
+		case "mean":
+			if means == nil {
+				if len(docs) == 0 {
+					return nil, fmt.Errorf("mean ablation needs training docs")
+				}
+				means = siteMeans(im, docs)
+			}
+			copy(full, means[site])
+		default:
+			return nil, fmt.Errorf("unknown ablation mode %q (use zero or mean)", a.Mode)
+		}
+
+		if index == nil {
+			edits[site] = siteEdit{values: full}
+			continue
+		}
+		// Merge neuron lists that target the same layer.
+		edit := edits[site]
+		for _, n := range index {
+			edit.index = append(edit.index, n)
+			edit.values = append(edit.values, full[n])
+		}
+		edits[site] = edit
+	}
+	return edits, nil
+}
+
+// ablationHooks builds generation hooks for opts.Ablations (nil when empty).
+//
+// Callers must hold model.mu.
+func ablationHooks(model *Model, ablations []Ablation, docs []string) (*forwardHooks, error) {
+	if len(ablations) == 0 {
+		return nil, nil
+	}
+	edits, err := ablationEdits(model.Inference(), ablations, docs)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardHooks{edits: edits}, nil
+}
+
+// siteMeans averages every hooked vector over all positions of docs.
+func siteMeans(im *InferenceModel, docs []string) map[hookSite][]float64 {
+	if len(docs) > maxMeanAblationDocs {
+		docs = docs[:maxMeanAblationDocs]
+	}
+	sums := make(map[hookSite][]float64)
+	count := 0
+	for _, doc := range docs {
+		tokens, err := inspectTokens(im, doc)
+		if err != nil {
+			continue
+		}
+		recs, err := captureActivations(im, tokens, nil)
+		if err != nil {
+			continue
+		}
+		for _, rec := range recs {
+			for site, v := range rec.vectors {
+				if sums[site] == nil {
+					sums[site] = make([]float64, len(v))
+				}
+				for i, x := range v {
+					sums[site][i] += x
+				}
+			}
+			count++
+		}
+	}
+	for _, sum := range sums {
+		for i := range sum {
+			sum[i] /= float64(count)
+		}
+	}
+	return sums
+}
+
+// scoreText compares next-token predictions with and without edits.
+func scoreText(im *InferenceModel, text string, tokens []int, edits map[hookSite]siteEdit) (AblateText, error) {
+	ablated := &forwardHooks{edits: edits}
+	baseLogits, err := runSequence(im, tokens, func(int) *forwardHooks { return nil })
+	if err != nil {
+		return AblateText{}, err
+	}
+	ablatedLogits, err := runSequence(im, tokens, func(int) *forwardHooks { return ablated })
+	if err != nil {
+		return AblateText{}, err
+	}
+
+	result := AblateText{Text: text, Positions: make([]AblatePosition, len(baseLogits))}
+	for pos := range baseLogits {
+		target := tokens[pos+1]
+		base := softmaxData(baseLogits[pos])
+		abl := softmaxData(ablatedLogits[pos])
+		result.BaseLoss += -math.Log(base[target])
+		result.AblatedLoss += -math.Log(abl[target])
+		result.Positions[pos] = AblatePosition{
+			Position:    pos,
+			Token:       tokenLabel(tokens[pos], im.BOS, im.Chars),
+			Target:      tokenLabel(target, im.BOS, im.Chars),
+			BaseProb:    base[target],
+			AblatedProb: abl[target],
+			DeltaProb:   abl[target] - base[target],
+			BaseTop:     tokenLabel(argmax(base), im.BOS, im.Chars),
+			AblatedTop:  tokenLabel(argmax(abl), im.BOS, im.Chars),
+		}
+	}
+	n := float64(len(baseLogits))
+	result.BaseLoss /= n
+	result.AblatedLoss /= n
+	result.DeltaLoss = result.AblatedLoss - result.BaseLoss
+	return result, nil
+}
+
+func argmax(xs []float64) int {
+	best := 0
+	for i, x := range xs {
+		if x > xs[best] {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// forwardHooks lets inspection code watch and edit one forward step.
+//
+// Both forward passes call it at the same named sites:
+// - "input": token (+ position) embedding sum, before emb_norm
+// - "embed": residual stream after the embeddings (and emb_norm)
+// - "head" (per layer and head): one attention head's output
+// - "attn_out" / "mlp_out": each block's output, before the residual add
+// - "after_attn" / "after_mlp": residual stream after each block
+// - "mlp_relu": MLP hidden neurons after ReLU
+//
+// edits replaces (part of) a site's vector, e.g. to knock out a component;
+// vectors, when non-nil, receives a copy of what flowed through each site.
+// leaves (graph path only) swaps each listed site's vector for fresh leaf
+// nodes, stored back into the map, so callers can read d(output)/d(site)
+// from their Grad after Backward.
+// A nil *forwardHooks does nothing, so normal calls pay nothing.
+type forwardHooks struct {
+	edits   map[hookSite]siteEdit
+	vectors map[hookSite][]float64
+	leaves  map[hookSite][]*Value
+}
+
+// hookSite names one place in the forward pass. Head is only used by "head";
+// Layer is unused by "embed".
+type hookSite struct {
+	Name  string
+	Layer int
+	Head  int
+}
+
+// siteEdit overwrites x[index[k]] with values[k], or all of x when index is nil.
+type siteEdit struct {
+	index  []int
+	values []float64
+}
+
+// newRecorder returns hooks that only record.
+func newRecorder() *forwardHooks {
+	return &forwardHooks{vectors: make(map[hookSite][]float64)}
+}
+
+// at applies any edit for site to x, then records the result.
+//
+// x itself is returned untouched when there is no edit, so a hooked
+// forward pass stays bit-identical to an unhooked one.
+func (h *forwardHooks) at(site hookSite, x []float64) []float64 {
+	if h == nil {
+		return x
+	}
+	if edit, ok := h.edits[site]; ok {
+		out := append([]float64(nil), x...)
+		if edit.index == nil {
+			copy(out, edit.values)
+		}
+		for k, i := range edit.index {
+			out[i] = edit.values[k]
+		}
+		x = out
+	}
+	if h.vectors != nil {
+		h.vectors[site] = append([]float64(nil), x...)
+	}
+	return x
+}
+
+// atValues is at for the graph path. Edited entries become constant nodes,
+// so no gradient flows through a knocked-out component.
+func (h *forwardHooks) atValues(site hookSite, x []*Value) []*Value {
+	if h == nil {
+		return x
+	}
+	if edit, ok := h.edits[site]; ok {
+		out := append([]*Value(nil), x...)
+		if edit.index == nil {
+			for i, v := range edit.values {
+				out[i] = NewValue(v)
+			}
+		}
+		for k, i := range edit.index {
+			out[i] = NewValue(edit.values[k])
+		}
+		x = out
+	}
+	if _, ok := h.leaves[site]; ok {
+		leaves := make([]*Value, len(x))
+		for i, v := range x {
+			leaves[i] = NewValue(v.Data)
+		}
+		h.leaves[site] = leaves
+		x = leaves
+	}
+	if h.vectors != nil {
+		data := make([]float64, len(x))
+		for i, v := range x {
+			data[i] = v.Data
+		}
+		h.vectors[site] = data
+	}
+	return x
+}
+
+// inspectTokens encodes text for the inspection endpoints: BOS, then one
+// token per character. Unlike encodeDoc it rejects characters the model
+// has never seen instead of silently dropping them.
+//
+// The returned tokens include the closing BOS, so position p predicts
+// tokens[p+1]; at most generationLimit positions are kept.
+func inspectTokens(im *InferenceModel, text string) ([]int, error) {
+	index := make(map[string]int, len(im.Chars))
+	for i, c := range im.Chars {
+		index[c] = i
+	}
+	tokens := []int{im.BOS}
+	for _, r := range text {
+		id, ok := index[string(r)]
+		if !ok {
+			return nil, fmt.Errorf("character %q is not in the model vocabulary", r)
+		}
+		tokens = append(tokens, id)
+	}
+	tokens = append(tokens, im.BOS)
+	if limit := generationLimit(im.Config, maxGenerateLen); len(tokens)-1 > limit {
+		tokens = tokens[:limit+1]
+	}
+	return tokens, nil
+}
+
+// runSequence feeds tokens[:len-1] through the float path and returns the
+// logits at every position. hooksAt may return per-position hooks (or nil).
+func runSequence(im *InferenceModel, tokens []int, hooksAt func(pos int) *forwardHooks) ([][]float64, error) {
+	cache := im.NewKVCache()
+	logits := make([][]float64, len(tokens)-1)
+	for pos := range logits {
+		var err error
+		if logits[pos], err = im.forward(tokens[pos], pos, cache, hooksAt(pos)); err != nil {
+			return nil, err
+		}
+	}
+	return logits, nil
+}
+
+// captureActivations runs tokens through the float path and returns one
+// recorder per position. edits (may be nil) apply at every position.
+func captureActivations(im *InferenceModel, tokens []int, edits map[hookSite]siteEdit) ([]*forwardHooks, error) {
+	recs := make([]*forwardHooks, len(tokens)-1)
+	_, err := runSequence(im, tokens, func(pos int) *forwardHooks {
+		recs[pos] = newRecorder()
+		recs[pos].edits = edits
+		return recs[pos]
+	})
+	return recs, err
+}
+
+// topNeuronsByChar averages each MLP neuron's post-ReLU activation over all
+// positions where a character is the input, and keeps the k strongest.
+func topNeuronsByChar(im *InferenceModel, tokens []int, recs []*forwardHooks, k int) []CharNeurons {
+	type charSum struct {
+		count int
+		sums  [][]float64 // [layer][neuron]
+	}
+	sums := map[int]*charSum{}
+	order := []int{}
+	for pos, rec := range recs {
+		tok := tokens[pos]
+		cs := sums[tok]
+		if cs == nil {
+			cs = &charSum{sums: make([][]float64, im.Config.NLayer)}
+			sums[tok] = cs
+			order = append(order, tok)
+		}
+		cs.count++
+		for li := range cs.sums {
+			act := rec.vectors[hookSite{Name: "mlp_relu", Layer: li}]
+			if cs.sums[li] == nil {
+				cs.sums[li] = make([]float64, len(act))
+			}
+			for n, a := range act {
+				cs.sums[li][n] += a
+			}
+		}
+	}
+
+	out := make([]CharNeurons, 0, len(order))
+	for _, tok := range order {
+		cs := sums[tok]
+		all := []NeuronActivation{}
+		for li, layer := range cs.sums {
+			for n, sum := range layer {
+				all = append(all, NeuronActivation{Layer: li, Neuron: n, Mean: sum / float64(cs.count)})
+			}
+		}
+		sort.SliceStable(all, func(a, b int) bool { return all[a].Mean > all[b].Mean })
+		if len(all) > k {
+			all = all[:k]
+		}
+		out = append(out, CharNeurons{Char: tokenLabel(tok, im.BOS, im.Chars), Count: cs.count, Top: all})
+	}
+	return out
+}
+
+// lensDepths lists the residual-stream sites decoded by the logit lens,
+// from the embeddings up to the last layer's output.
+func lensDepths(c Config) []hookSite {
+	depths := []hookSite{{Name: "embed"}}
+	for li := 0; li < c.NLayer; li++ {
+		depths = append(depths, hookSite{Name: "after_attn", Layer: li}, hookSite{Name: "after_mlp", Layer: li})
+	}
+	return depths
+}
+
+// String is the site's display name, e.g. "layer1.after_mlp" or "layer0.head2".
+func (s hookSite) String() string {
+	switch s.Name {
+	case "input", "embed":
+		return s.Name
+	case "head":
+		return fmt.Sprintf("layer%d.head%d", s.Layer, s.Head)
+	}
+	return fmt.Sprintf("layer%d.%s", s.Layer, s.Name)
+}
+
+// decodeResidual applies the model's output head to an intermediate residual
+// stream, as if the remaining layers did not exist ("logit lens").
+//
+// The final norm is applied first when configured, so the last depth
+// reproduces the real logits exactly.
+func decodeResidual(im *InferenceModel, x []float64) []float64 {
+	if im.Config.FinalNorm {
+		x = im.normalize(x, "final_norm")
+	}
+	return linearData(x, im.Weights["lm_head"])
+}
@@ -2,12 +2,34 @@ package main
 
 // InitRequest is the payload for /api/init.
 // It provides training docs and model hyperparameters.
+//
+// Validation docs are never trained on; they only measure generalization.
+// Either list them in ValidationDocs or hold out a random ValidationSplit
+// fraction of Docs.
+//
+// Target "draft" initializes the draft model used for speculative decoding
+// instead: it reuses the main model's vocabulary and training docs, so Docs
+// and the validation fields are ignored.
 type InitRequest struct {
-	Docs   []string `json:"docs"`
-	Config Config   `json:"config"`
+	Target          string   `json:"target,omitempty"`
+	Docs            []string `json:"docs"`
+	Config          Config   `json:"config"`
+	ValidationDocs  []string `json:"validation_docs,omitempty"`
+	ValidationSplit float64  `json:"validation_split,omitempty"`
 }
 
 // TrainResponse reports one training step summary.
+//
+// GraphNodes is the number of autograd Value nodes built for one optimizer
+// step (summed over the mini-batch).
+//
+// When validation docs exist, TrainEvalLoss and ValLoss score up to
+// TrainRequest.EvalDocs training and validation docs in evaluation mode (no
+// dropout) after the last step, on calls that reach a multiple of ValEvery.
+// A growing gap between them means the model is memorizing.
+//
+// Seed is the seed this call used; sending it back with the same starting
+// model reproduces the call exactly, whatever the worker count.
 type TrainResponse struct {
 	Step          int     `json:"step"`
 	Loss          float64 `json:"loss"`
@@ -16,14 +38,30 @@ type TrainResponse struct {
 	PredictedChar string  `json:"predicted_char"`
 	TargetProb    float64 `json:"target_prob"`
 	PredictedProb float64 `json:"predicted_prob"`
+	GraphNodes    int     `json:"graph_nodes"`
+	TrainEvalLoss float64 `json:"train_eval_loss,omitempty"`
+	ValLoss       float64 `json:"val_loss,omitempty"`
+	Seed          int64   `json:"seed"`
+	Workers       int     `json:"workers"`
 }
 
 // TrainRequest controls how much work /api/train performs in one call.
 //
 // All fields are optional; server uses safe defaults when omitted.
+// Workers is how many goroutines build batch rows in parallel
+// (default 1, capped at batch_size and GOMAXPROCS). Seed (0 = random) fixes which docs
+// are sampled and every dropout mask. Target "draft" trains the draft model
+// on the same docs. ValEvery (default 1) evaluates only when the step count
+// reaches a multiple of it; EvalDocs (default 200) caps how many docs of
+// each set are scored.
 type TrainRequest struct {
-	StepsPerCall int `json:"steps_per_call"`
-	BatchSize    int `json:"batch_size"`
+	Target       string `json:"target,omitempty"`
+	StepsPerCall int    `json:"steps_per_call"`
+	BatchSize    int    `json:"batch_size"`
+	Workers      int    `json:"workers,omitempty"`
+	Seed         int64  `json:"seed,omitempty"`
+	ValEvery     int    `json:"val_every,omitempty"`
+	EvalDocs     int    `json:"eval_docs,omitempty"`
 }
 
 // GenerateOptions controls stochastic sampling behavior.
@@ -39,10 +77,49 @@ type TrainRequest struct {
 //
 // MinLen:
 // - minimum characters to emit before allowing <END>.
+//
+// MaxLen:
+// - 0 => stop at block_size (the classic limit)
+// - N => allow up to N positions
+// - going past block_size only works for sinusoidal, rope and alibi encodings.
+//
+// KVWindow:
+// - 0 => every position attends to the whole sample so far
+// - N => only the newest N positions are kept in the KV cache (sliding window)
 type GenerateOptions struct {
 	Temperature float64 `json:"temperature"`
 	TopK        int     `json:"top_k"`
 	MinLen      int     `json:"min_len"`
+	MaxLen      int     `json:"max_len,omitempty"`
+	KVWindow    int     `json:"kv_window,omitempty"`
+
+	// Precision samples from a frozen float32 or int8 export of the weights
+	// ("" or "float64" = the trained weights as they are). Quantization is
+	// weight-only: the forward pass itself still runs in float64.
+	Precision string `json:"precision,omitempty"`
+
+	// Constraints (see constraint.go): only AllowedChars (if set) may appear,
+	// BannedChars never, and the whole sample must match Pattern (a regular
+	// expression). With constraints, MaxLen is a hard length budget the
+	// pattern is guaranteed to fit in.
+	AllowedChars string `json:"allowed_chars,omitempty"`
+	BannedChars  string `json:"banned_chars,omitempty"`
+	Pattern      string `json:"pattern,omitempty"`
+
+	// Penalties against repeating characters already in the sample
+	// (0 = off; see applyPenalties). RepetitionPenalty > 1 divides a seen
+	// token's positive logit (multiplies a negative one); FrequencyPenalty is
+	// subtracted once per occurrence and PresencePenalty once per seen token.
+	RepetitionPenalty float64 `json:"repetition_penalty,omitempty"`
+	FrequencyPenalty  float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty   float64 `json:"presence_penalty,omitempty"`
+
+	// DraftTokens > 0 turns on speculative decoding: the draft model proposes
+	// this many characters per round and the main model verifies them.
+	DraftTokens int `json:"draft_tokens,omitempty"`
+
+	// Ablations knock out model components while sampling (see Ablation).
+	Ablations []Ablation `json:"ablations,omitempty"`
 }
 
 // GenerateRequest allows options for /api/generate and /api/generate_trace.
@@ -51,30 +128,573 @@ type GenerateRequest struct {
 }
 
 // TraceCandidate is one candidate token shown in generation trace.
+//
+// Logit is after temperature. In generation traces, LogitBeforePenalty and
+// LogitAfterPenalty are the model's raw logit and the logit after the
+// repetition/frequency/presence penalties (both before temperature). They
+// are pointers so a logit of 0 is still sent, while candidates outside
+// generation traces (e.g. the logit lens) leave them out.
 type TraceCandidate struct {
+	Char               string   `json:"char"`
+	TokenID            int      `json:"token_id"`
+	Logit              float64  `json:"logit"`
+	Prob               float64  `json:"prob"`
+	LogitBeforePenalty *float64 `json:"logit_before_penalty,omitempty"`
+	LogitAfterPenalty  *float64 `json:"logit_after_penalty,omitempty"`
+}
+
+// TraceStep explains one sampled generation position.
+//
+// CacheLen and CacheBytes describe the KV cache after this position was read
+// (with speculative decoding: after the round's rejected entries are dropped).
+// Draft is only set with speculative decoding. Masked lists the most likely
+// candidates removed by constraints and MaskedProb their total probability.
+type TraceStep struct {
+	Position   int               `json:"position"`
+	Context    string            `json:"context"`
+	TopK       []TraceCandidate  `json:"top_k"`
+	RandomU    float64           `json:"random_u"`
+	ChosenChar string            `json:"chosen_char"`
+	ChosenProb float64           `json:"chosen_prob"`
+	ChosenRank int               `json:"chosen_rank"`
+	CumBefore  float64           `json:"cum_before"`
+	CumAfter   float64           `json:"cum_after"`
+	Reason     string            `json:"reason"`
+	CacheLen   int               `json:"cache_len"`
+	CacheBytes int               `json:"cache_bytes"`
+	Draft      *DraftDecision    `json:"draft,omitempty"`
+	Masked     []MaskedCandidate `json:"masked,omitempty"`
+	MaskedProb float64           `json:"masked_prob,omitempty"`
+}
+
+// MaskedCandidate is a token a constraint forbade at one step. Prob is its
+// probability before masking (temperature applied, no top-k); Reason says
+// which rule removed it.
+type MaskedCandidate struct {
 	Char    string  `json:"char"`
 	TokenID int     `json:"token_id"`
 	Logit   float64 `json:"logit"`
 	Prob    float64 `json:"prob"`
+	Reason  string  `json:"reason"`
 }
 
-// TraceStep explains one sampled generation position.
-type TraceStep struct {
-	Position   int              `json:"position"`
-	Context    string           `json:"context"`
-	TopK       []TraceCandidate `json:"top_k"`
-	RandomU    float64          `json:"random_u"`
-	ChosenChar string           `json:"chosen_char"`
-	ChosenProb float64          `json:"chosen_prob"`
-	ChosenRank int              `json:"chosen_rank"`
-	CumBefore  float64          `json:"cum_before"`
-	CumAfter   float64          `json:"cum_after"`
-	Reason     string           `json:"reason"`
+// DraftDecision explains how one speculative-decoding step was decided.
+//
+// Outcome is "accepted" (the draft's proposal was kept), "rejected" (the
+// step's character was resampled from max(0, p - q)) or "bonus" (all of the
+// round's proposals were kept and the target sampled one more).
+// For proposals, DraftProb is q(x), TargetProb p(x), and the proposal is
+// kept when AcceptU < AcceptProb = min(1, p/q). These are always sent, as
+// 0 is a valid probability; a "bonus" step has no proposal and sends 0.
+type DraftDecision struct {
+	Round      int     `json:"round"`
+	Outcome    string  `json:"outcome"`
+	Proposed   string  `json:"proposed,omitempty"`
+	DraftProb  float64 `json:"draft_prob"`
+	TargetProb float64 `json:"target_prob"`
+	AcceptProb float64 `json:"accept_prob"`
+	AcceptU    float64 `json:"accept_u"`
+}
+
+// SpeculativeStats summarizes one speculative generation.
+//
+// Rounds is the number of draft-and-verify rounds; TokensPerPass is how
+// many characters (including <END>) each round produced on average, versus 1
+// for plain sampling. Each round still runs the target once per position.
+type SpeculativeStats struct {
+	DraftTokens    int     `json:"draft_tokens"`
+	Rounds         int     `json:"rounds"`
+	Proposed       int     `json:"proposed"`
+	Accepted       int     `json:"accepted"`
+	AcceptanceRate float64 `json:"acceptance_rate"`
+	TokensPerPass  float64 `json:"tokens_per_pass"`
 }
 
 // GenerateTraceResponse is returned by /api/generate_trace.
 type GenerateTraceResponse struct {
-	Text       string      `json:"text"`
-	Steps      []TraceStep `json:"steps"`
-	StopReason string      `json:"stop_reason"`
+	Text        string            `json:"text"`
+	Steps       []TraceStep       `json:"steps"`
+	StopReason  string            `json:"stop_reason"`
+	Speculative *SpeculativeStats `json:"speculative,omitempty"`
+}
+
+// StepRecord is one optimizer step in a model's training log.
+//
+// WallTime is the Unix time (seconds) when the step finished;
+// DurationMs is how long the step took. ValLoss is only set on the last
+// step of an /api/train call that evaluated (see TrainRequest.ValEvery).
+type StepRecord struct {
+	Step         int     `json:"step"`
+	Loss         float64 `json:"loss"`
+	LearningRate float64 `json:"learning_rate"`
+	GradNorm     float64 `json:"grad_norm"`
+	BatchSize    int     `json:"batch_size"`
+	WallTime     float64 `json:"wall_time"`
+	DurationMs   float64 `json:"duration_ms"`
+	ValLoss      float64 `json:"val_loss,omitempty"`
+}
+
+// HistoryResponse is returned by GET /api/history.
+//
+// Config and Params identify the run so exported logs can be compared offline.
+// Docs are the training docs, so the UI can show them again after a reload.
+type HistoryResponse struct {
+	Config      Config       `json:"config"`
+	Params      int          `json:"params"`
+	Docs        []string     `json:"docs"`
+	Total       int          `json:"total"`
+	Downsampled bool         `json:"downsampled"`
+	Points      []StepRecord `json:"points"`
+}
+
+// EmbeddingNeighbor is one similar vector in an embedding table.
+type EmbeddingNeighbor struct {
+	Label      string  `json:"label"`
+	Index      int     `json:"index"`
+	Similarity float64 `json:"similarity"`
+}
+
+// EmbeddingPoint is one row of an embedding table (a character or a position).
+type EmbeddingPoint struct {
+	Label     string              `json:"label"`
+	Index     int                 `json:"index"`
+	Vector    []float64           `json:"vector"`
+	PCA       [2]float64          `json:"pca"`
+	TSNE      *[2]float64         `json:"tsne,omitempty"`
+	Neighbors []EmbeddingNeighbor `json:"neighbors"`
+}
+
+// EmbeddingTable is one embedding matrix with its 2-D projections.
+//
+// PCAExplained is the fraction of variance captured by each PCA axis.
+type EmbeddingTable struct {
+	Name         string           `json:"name"`
+	PCAExplained [2]float64       `json:"pca_explained"`
+	Points       []EmbeddingPoint `json:"points"`
+}
+
+// EmbeddingsResponse is returned by GET /api/inspect/embeddings.
+type EmbeddingsResponse struct {
+	Step     int             `json:"step"`
+	Token    EmbeddingTable  `json:"token"`
+	Position *EmbeddingTable `json:"position,omitempty"`
+}
+
+// MatrixInfo describes one named matrix in Model.State.
+//
+// SharedWith is set when the matrix reuses another one's Values (weight
+// tying); such matrices report Params = 0 because they are counted once.
+type MatrixInfo struct {
+	Name       string `json:"name"`
+	Component  string `json:"component"`
+	Rows       int    `json:"rows"`
+	Cols       int    `json:"cols"`
+	Params     int    `json:"params"`
+	SharedWith string `json:"shared_with,omitempty"`
+}
+
+// ParamGroup is a block of the model ("embeddings", "layer0", ..., "output").
+type ParamGroup struct {
+	Name     string       `json:"name"`
+	Params   int          `json:"params"`
+	Percent  float64      `json:"percent"`
+	Matrices []MatrixInfo `json:"matrices"`
+}
+
+// AttentionShape summarizes how query heads share key/value heads.
+type AttentionShape struct {
+	QueryHeads    int `json:"query_heads"`
+	KVHeads       int `json:"kv_heads"`
+	HeadDim       int `json:"head_dim"`
+	QueriesPerKV  int `json:"queries_per_kv"`
+	KVDimPerLayer int `json:"kv_dim_per_layer"`
+}
+
+// KVCacheEstimate is the size of a full (block_size) KV cache.
+//
+// Float64Bytes is the graph-free inference cache; ValueGraphBytes is the
+// same cache held as autograd Value nodes during training.
+type KVCacheEstimate struct {
+	ValuesPerToken  int `json:"values_per_token"`
+	Positions       int `json:"positions"`
+	TotalValues     int `json:"total_values"`
+	Float64Bytes    int `json:"float64_bytes"`
+	ValueGraphBytes int `json:"value_graph_bytes"`
+}
+
+// GraphEstimate measures the autograd graph for one training example of
+// block_size positions; a training step builds batch_size of these.
+type GraphEstimate struct {
+	Positions        int `json:"positions"`
+	NodesPerExample  int `json:"nodes_per_example"`
+	BytesPerNode     int `json:"bytes_per_node"`
+	BytesPerExample  int `json:"bytes_per_example"`
+	DefaultBatchSize int `json:"default_batch_size"`
+	BytesPerStep     int `json:"bytes_per_step"`
+}
+
+// ModelSummaryResponse is returned by GET /api/model.
+//
+// FLOPsPerToken counts multiply+add as 2 FLOPs for one forward step at a
+// full block_size context: MatmulFLOPs (all Linear layers) plus
+// AttentionFLOPs (q·k scores and the weighted sum of values).
+type ModelSummaryResponse struct {
+	Config         Config          `json:"config"`
+	Vocab          []string        `json:"vocab"`
+	VocabSize      int             `json:"vocab_size"`
+	Steps          int             `json:"steps"`
+	Params         int             `json:"params"`
+	Groups         []ParamGroup    `json:"groups"`
+	Attention      AttentionShape  `json:"attention"`
+	MatmulFLOPs    int             `json:"matmul_flops_per_token"`
+	AttentionFLOPs int             `json:"attention_flops_per_token"`
+	FLOPsPerToken  int             `json:"flops_per_token"`
+	KVCache        KVCacheEstimate `json:"kv_cache"`
+	Graph          GraphEstimate   `json:"graph"`
+}
+
+// Histogram counts values in Bins equal-width buckets between Min and Max.
+type Histogram struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Counts []int   `json:"counts"`
+}
+
+// MatrixStats summarizes one weight matrix, its last gradient and its last
+// Adam update.
+//
+// NearZero is the fraction of weights with |w| below the threshold.
+// UpdateRatio is ||Adam update|| / ||W||; healthy training is often ~1e-3,
+// much larger means weights are thrashing, much smaller means they are stuck.
+type MatrixStats struct {
+	Name        string    `json:"name"`
+	Params      int       `json:"params"`
+	Mean        float64   `json:"mean"`
+	Std         float64   `json:"std"`
+	Min         float64   `json:"min"`
+	Max         float64   `json:"max"`
+	NearZero    float64   `json:"near_zero"`
+	Histogram   Histogram `json:"histogram"`
+	GradMean    float64   `json:"grad_mean"`
+	GradStd     float64   `json:"grad_std"`
+	GradNorm    float64   `json:"grad_norm"`
+	GradMaxAbs  float64   `json:"grad_max_abs"`
+	UpdateRatio float64   `json:"update_ratio"`
+}
+
+// WeightSnapshot is the state of every matrix at one optimizer step.
+type WeightSnapshot struct {
+	Step     int           `json:"step"`
+	Matrices []MatrixStats `json:"matrices"`
+}
+
+// WeightsResponse is returned by GET /api/inspect/weights.
+type WeightsResponse struct {
+	Step              int              `json:"step"`
+	NearZeroThreshold float64          `json:"near_zero_threshold"`
+	Bins              int              `json:"bins"`
+	Matrices          []MatrixStats    `json:"matrices"`
+	History           []WeightSnapshot `json:"history,omitempty"`
+}
+
+// ActivationsRequest is the body for POST /api/inspect/activations.
+//
+// Text is fed as BOS + characters; TopNeurons (default 5) is how many
+// neurons to list per character.
+type ActivationsRequest struct {
+	Text       string `json:"text"`
+	TopNeurons int    `json:"top_neurons,omitempty"`
+}
+
+// LayerActivations holds one layer's captured vectors at one position.
+//
+// AfterAttn and AfterMLP are the residual stream after each block;
+// MLPRelu is the MLP hidden layer after ReLU (one value per neuron).
+type LayerActivations struct {
+	Layer     int       `json:"layer"`
+	AfterAttn []float64 `json:"after_attn"`
+	MLPRelu   []float64 `json:"mlp_relu"`
+	AfterMLP  []float64 `json:"after_mlp"`
+}
+
+// ActivationPosition is everything captured while processing one input token.
+type ActivationPosition struct {
+	Position int                `json:"position"`
+	Token    string             `json:"token"`
+	Embed    []float64          `json:"embed"`
+	Layers   []LayerActivations `json:"layers"`
+}
+
+// NeuronActivation is one MLP neuron's mean post-ReLU activation.
+type NeuronActivation struct {
+	Layer  int     `json:"layer"`
+	Neuron int     `json:"neuron"`
+	Mean   float64 `json:"mean"`
+}
+
+// CharNeurons lists the neurons that fire most when Char is the input.
+type CharNeurons struct {
+	Char  string             `json:"char"`
+	Count int                `json:"count"`
+	Top   []NeuronActivation `json:"top"`
+}
+
+// ActivationsResponse is returned by POST /api/inspect/activations.
+type ActivationsResponse struct {
+	Step          int                  `json:"step"`
+	Tokens        []string             `json:"tokens"`
+	Positions     []ActivationPosition `json:"positions"`
+	NeuronsByChar []CharNeurons        `json:"neurons_by_char"`
+}
+
+// LogitLensRequest is the body for POST /api/inspect/logit_lens.
+type LogitLensRequest struct {
+	Text string `json:"text"`
+	TopK int    `json:"top_k,omitempty"`
+}
+
+// LensDepth is the model's "opinion so far" at one point in the stack.
+//
+// Depth names the residual stream that was decoded ("embed",
+// "layer0.after_attn", "layer0.after_mlp", ...). TargetRank is 1 when the
+// actual next token is the top prediction.
+type LensDepth struct {
+	Depth      string           `json:"depth"`
+	Top        []TraceCandidate `json:"top"`
+	TargetProb float64          `json:"target_prob"`
+	TargetRank int              `json:"target_rank"`
+}
+
+// LensPosition holds the logit lens for one input position.
+type LensPosition struct {
+	Position int         `json:"position"`
+	Token    string      `json:"token"`
+	Target   string      `json:"target"`
+	Depths   []LensDepth `json:"depths"`
+}
+
+// LogitLensResponse is returned by POST /api/inspect/logit_lens.
+type LogitLensResponse struct {
+	Step      int            `json:"step"`
+	FinalNorm bool           `json:"final_norm"`
+	Tokens    []string       `json:"tokens"`
+	Positions []LensPosition `json:"positions"`
+}
+
+// Ablation knocks out one model component during a forward pass.
+//
+// Component is one of:
+// - "head": attention head Head in Layer
+// - "attn": Layer's whole attention block output
+// - "mlp": Layer's whole MLP block output
+// - "neurons": the listed MLP neurons (after ReLU) in Layer
+//
+// Mode "zero" (default) replaces the output with zeros; "mean" replaces it
+// with its average over the training docs, which removes the component's
+// information without pushing activations somewhere unusual.
+type Ablation struct {
+	Component string `json:"component"`
+	Layer     int    `json:"layer"`
+	Head      int    `json:"head,omitempty"`
+	Neurons   []int  `json:"neurons,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+}
+
+// AblateRequest is the body for POST /api/inspect/ablate.
+//
+// Texts defaults to (up to 20 of) the training docs.
+type AblateRequest struct {
+	Texts     []string   `json:"texts,omitempty"`
+	Ablations []Ablation `json:"ablations"`
+}
+
+// AblatePosition compares the next-token prediction at one position.
+type AblatePosition struct {
+	Position    int     `json:"position"`
+	Token       string  `json:"token"`
+	Target      string  `json:"target"`
+	BaseProb    float64 `json:"base_prob"`
+	AblatedProb float64 `json:"ablated_prob"`
+	DeltaProb   float64 `json:"delta_prob"`
+	BaseTop     string  `json:"base_top"`
+	AblatedTop  string  `json:"ablated_top"`
+}
+
+// AblateText is the effect of the ablations on one string.
+//
+// Losses are average next-token cross-entropy, like the training loss.
+type AblateText struct {
+	Text        string           `json:"text"`
+	BaseLoss    float64          `json:"base_loss"`
+	AblatedLoss float64          `json:"ablated_loss"`
+	DeltaLoss   float64          `json:"delta_loss"`
+	Positions   []AblatePosition `json:"positions"`
+}
+
+// AblateResponse is returned by POST /api/inspect/ablate.
+type AblateResponse struct {
+	Step        int          `json:"step"`
+	Ablations   []Ablation   `json:"ablations"`
+	BaseLoss    float64      `json:"base_loss"`
+	AblatedLoss float64      `json:"ablated_loss"`
+	DeltaLoss   float64      `json:"delta_loss"`
+	Texts       []AblateText `json:"texts"`
+}
+
+// PatchRequest is the body for POST /api/inspect/patch.
+//
+// Clean and Corrupted must have the same length so positions line up.
+// Target is the character whose probability is measured after the last
+// input character ("<END>" allowed); it defaults to the clean run's top
+// prediction. Site is "residual" (default) or "head".
+type PatchRequest struct {
+	Clean     string `json:"clean"`
+	Corrupted string `json:"corrupted"`
+	Target    string `json:"target,omitempty"`
+	Site      string `json:"site,omitempty"`
+}
+
+// PatchRow is one patched site swept over every position.
+//
+// Prob[p] is the target probability when this site's clean vector is copied
+// into the corrupted run at position p; Restored[p] rescales it so 0 means
+// "no better than corrupted" and 1 means "fully back to clean".
+type PatchRow struct {
+	Site     string    `json:"site"`
+	Prob     []float64 `json:"prob"`
+	Restored []float64 `json:"restored"`
+}
+
+// PatchResponse is returned by POST /api/inspect/patch.
+type PatchResponse struct {
+	Step            int        `json:"step"`
+	Site            string     `json:"site"`
+	Target          string     `json:"target"`
+	CleanTokens     []string   `json:"clean_tokens"`
+	CorruptedTokens []string   `json:"corrupted_tokens"`
+	CleanProb       float64    `json:"clean_prob"`
+	CorruptedProb   float64    `json:"corrupted_prob"`
+	Rows            []PatchRow `json:"rows"`
+}
+
+// SaliencyRequest is the body for POST /api/inspect/saliency.
+//
+// Target is the next character to explain ("<END>" allowed); it defaults
+// to the model's top prediction after Text.
+type SaliencyRequest struct {
+	Text   string `json:"text"`
+	Target string `json:"target,omitempty"`
+}
+
+// SaliencyPosition scores how much one input position drove the prediction.
+//
+// GradNorm is ||g|| where g = d log p(target) / d (input embedding).
+// GradXToken and GradXPosition split g·input between the token and position
+// embeddings (GradXPosition is 0 for rope/alibi, which have none).
+type SaliencyPosition struct {
+	Position      int     `json:"position"`
+	Token         string  `json:"token"`
+	GradNorm      float64 `json:"grad_norm"`
+	GradXInput    float64 `json:"grad_x_input"`
+	GradXToken    float64 `json:"grad_x_token"`
+	GradXPosition float64 `json:"grad_x_position"`
+}
+
+// SaliencyResponse is returned by POST /api/inspect/saliency.
+type SaliencyResponse struct {
+	Step       int                `json:"step"`
+	Target     string             `json:"target"`
+	TargetProb float64            `json:"target_prob"`
+	LogProb    float64            `json:"log_prob"`
+	Positions  []SaliencyPosition `json:"positions"`
+}
+
+// KVCacheRequest is the body for POST /api/inspect/kv_cache.
+//
+// Window > 0 keeps only the newest Window positions, like GenerateOptions.KVWindow.
+type KVCacheRequest struct {
+	Text   string `json:"text"`
+	Window int    `json:"window,omitempty"`
+}
+
+// KVCacheEntry is one cached position in one layer. Key is stored already
+// rotated for rope models; with grouped-query attention both vectors hold
+// n_kv_head heads.
+type KVCacheEntry struct {
+	Position int       `json:"position"`
+	Token    string    `json:"token"`
+	Key      []float64 `json:"key"`
+	Value    []float64 `json:"value"`
+}
+
+// KVCacheLayer lists one layer's cached entries, oldest first.
+type KVCacheLayer struct {
+	Layer   int            `json:"layer"`
+	Entries []KVCacheEntry `json:"entries"`
+}
+
+// KVCacheResponse is returned by POST /api/inspect/kv_cache.
+//
+// Tokens are the inputs that were read (BOS first); Start is the absolute
+// position of the oldest entry still cached and Bytes the float64 memory held.
+type KVCacheResponse struct {
+	Step   int            `json:"step"`
+	Tokens []string       `json:"tokens"`
+	Window int            `json:"window"`
+	Start  int            `json:"start"`
+	Len    int            `json:"len"`
+	Bytes  int            `json:"bytes"`
+	Layers []KVCacheLayer `json:"layers"`
+}
+
+// QuantizationRequest is the body for POST /api/inspect/quantization.
+//
+// Training docs (at most MaxDocs, default 200) are scored at every
+// precision; Text, when set, is also reported token by token.
+type QuantizationRequest struct {
+	Text    string `json:"text,omitempty"`
+	MaxDocs int    `json:"max_docs,omitempty"`
+}
+
+// PrecisionReport compares one precision with the float64 weights.
+//
+// Loss is the mean next-token cross-entropy (nats) and Perplexity its exp.
+// MeanKL / MaxKL measure how far the next-token distributions moved, per
+// token; TopAgreement is the share of positions with the same top-1 choice.
+type PrecisionReport struct {
+	Precision      string  `json:"precision"`
+	Bytes          int     `json:"bytes"`
+	Loss           float64 `json:"loss"`
+	Perplexity     float64 `json:"perplexity"`
+	PerplexityDiff float64 `json:"perplexity_diff"`
+	MeanKL         float64 `json:"mean_kl"`
+	MaxKL          float64 `json:"max_kl"`
+	TopAgreement   float64 `json:"top_agreement"`
+}
+
+// QuantizationToken is one position of the request text.
+type QuantizationToken struct {
+	Position    int     `json:"position"`
+	Token       string  `json:"token"`
+	Target      string  `json:"target"`
+	KLFloat32   float64 `json:"kl_float32"`
+	KLInt8      float64 `json:"kl_int8"`
+	LossFloat64 float64 `json:"loss_float64"`
+	LossFloat32 float64 `json:"loss_float32"`
+	LossInt8    float64 `json:"loss_int8"`
+}
+
+// QuantizationResponse is returned by POST /api/inspect/quantization.
+//
+// Scheme is always "weight-only": the weights are rounded, then computed
+// with in float64. ValueGraphBytes is the trained model's parameters held as
+// autograd nodes, for comparison with the frozen forms' Bytes.
+type QuantizationResponse struct {
+	Scheme          string              `json:"scheme"`
+	Step            int                 `json:"step"`
+	Docs            int                 `json:"docs"`
+	Tokens          int                 `json:"tokens"`
+	ValueGraphBytes int                 `json:"value_graph_bytes"`
+	Precisions      []PrecisionReport   `json:"precisions"`
+	Text            []QuantizationToken `json:"text,omitempty"`
 }
@@ -105,7 +105,24 @@ func (v *Value) Relu() *Value {
 // 1) Build topological order so each node is visited only after its children.
 // 2) Seed output gradient with 1 (dOutput/dOutput = 1).
 // 3) Traverse graph in reverse topological order and accumulate gradients.
-func (v *Value) Backward() {
+//
+// It returns how many nodes the graph contained, which is a handy measure of
+// how much memory one forward pass allocated.
+func (v *Value) Backward() int {
+	topo := v.topoOrder()
+
+	v.Grad = 1
+	for i := len(topo) - 1; i >= 0; i-- {
+		curr := topo[i]
+		for j, child := range curr.Children {
+			child.Grad += curr.LocalGrads[j] * curr.Grad
+		}
+	}
+	return len(topo)
+}
+
+// topoOrder lists every node reachable from v, children before parents.
+func (v *Value) topoOrder() []*Value {
 	topo := []*Value{}
 	visited := make(map[*Value]bool)
 
@@ -121,12 +138,5 @@ func (v *Value) Backward() {
 		topo = append(topo, node)
 	}
 	buildTopo(v)
-
-	v.Grad = 1
-	for i := len(topo) - 1; i >= 0; i-- {
-		curr := topo[i]
-		for j, child := range curr.Children {
-			child.Grad += curr.LocalGrads[j] * curr.Grad
-		}
-	}
+	return topo
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+)
+
+// maxPatternStates caps how many DFA states one pattern may create.
+const maxPatternStates = 10000
+
+// generationConstraint masks tokens that would break the options' rules
+// (allowed chars, banned chars, a pattern the whole sample must match) before
+// each character is sampled; the rest are renormalized. The pattern becomes a
+// DFA whose state is how much of it is matched so far. A character is only
+// allowed if the pattern can still be finished within the remaining length,
+// and <END> only once it is complete, so every sample matches.
+//
+// A nil *generationConstraint allows everything.
+type generationConstraint struct {
+	chars   []string
+	bos     int
+	limit   int    // generation positions; the sample can never be longer
+	charOK  []bool // per char token: passes allowed/banned
+	pattern *patternDFA
+}
+
+// newConstraint builds the constraint for opts, or nil when opts sets none.
+// limit is the generation length budget (see generationLimit).
+func newConstraint(model *Model, opts GenerateOptions, limit int) (*generationConstraint, error) {
+	if opts.AllowedChars == "" && opts.BannedChars == "" && opts.Pattern == "" {
+		return nil, nil
+	}
+	index := make(map[rune]int, len(model.Chars))
+	for i, c := range model.Chars {
+		index[[]rune(c)[0]] = i
+	}
+	lookup := func(field, list string) ([]int, error) {
+		ids := []int{}
+		for _, r := range list {
+			id, ok := index[r]
+			if !ok {
+				return nil, fmt.Errorf("%s: character %q is not in the model vocabulary", field, r)
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+
+	c := &generationConstraint{chars: model.Chars, bos: model.BOS, limit: limit, charOK: make([]bool, len(model.Chars))}
+	if opts.AllowedChars == "" {
+		for i := range c.charOK {
+			c.charOK[i] = true
+		}
+	} else {
+		ids, err := lookup("allowed_chars", opts.AllowedChars)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			c.charOK[id] = true
+		}
+	}
+	banned, err := lookup("banned_chars", opts.BannedChars)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range banned {
+		c.charOK[id] = false
+	}
+
+	if opts.Pattern != "" {
+		if c.pattern, err = newPatternDFA(opts.Pattern, model.Chars, c.charOK); err != nil {
+			return nil, err
+		}
+		if d := c.pattern.distance(0); d > limit {
+			return nil, fmt.Errorf("pattern cannot be matched within %d characters with the allowed characters", limit)
+		}
+	}
+	return c, nil
+}
+
+// mask returns which tokens may follow a sample of length n in pattern
+// state, and for masked tokens why (allowed[i] == false, reasons[i] != "").
+// Both are nil when c is nil.
+func (c *generationConstraint) mask(state, n int) (allowed []bool, reasons []string) {
+	if c == nil {
+		return nil, nil
+	}
+	allowed = make([]bool, len(c.chars)+1)
+	reasons = make([]string, len(c.chars)+1)
+	for id := range c.chars {
+		switch {
+		case !c.charOK[id]:
+			reasons[id] = "character not allowed"
+		case c.pattern == nil:
+			allowed[id] = true
+		default:
+			next := c.pattern.step(state, id)
+			if next < 0 {
+				reasons[id] = "breaks the pattern"
+			} else if c.pattern.distance(next) > c.limit-n-1 {
+				reasons[id] = "pattern could not be finished within the length limit"
+			} else {
+				allowed[id] = true
+			}
+		}
+	}
+	if c.pattern == nil || c.pattern.accepts(state) {
+		allowed[c.bos] = true
+	} else {
+		reasons[c.bos] = "pattern is not complete yet"
+	}
+	return allowed, reasons
+}
+
+// next is the pattern state after tokenID (0 when there is no pattern).
+func (c *generationConstraint) next(state, tokenID int) int {
+	if c == nil || c.pattern == nil || tokenID == c.bos {
+		return state
+	}
+	return c.pattern.step(state, tokenID)
+}
+
+// maskedCandidates lists the most likely masked tokens (by their
+// unconstrained probability) for the trace, plus the total probability
+// the mask removed.
+func maskedCandidates(raw []float64, reasons []string, chars []string, bos, k int) ([]MaskedCandidate, float64) {
+	if reasons == nil {
+		return nil, 0
+	}
+	probs := softmaxData(raw)
+	out := []MaskedCandidate{}
+	removed := 0.0
+	for id, reason := range reasons {
+		if reason == "" {
+			continue
+		}
+		removed += probs[id]
+		out = append(out, MaskedCandidate{Char: tokenLabel(id, bos, chars), TokenID: id, Logit: raw[id], Prob: probs[id], Reason: reason})
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Prob > out[b].Prob })
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out, removed
+}
+
+// patternDFA runs a regular expression over vocabulary tokens. States are
+// built lazily from the compiled regexp program (subset construction), and
+// the whole sample must match (the pattern is implicitly anchored).
+type patternDFA struct {
+	prog   *syntax.Prog
+	runes  []rune // rune of each char token
+	charOK []bool
+
+	ids    map[string]int
+	sets   [][]uint32 // program counters per state
+	trans  [][]int    // [state][char token] => state, -1 dead, -2 not built
+	finals []bool
+	dist   []int // cached distance to acceptance (-1 unknown)
+}
+
+func newPatternDFA(pattern string, chars []string, charOK []bool) (*patternDFA, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	for _, inst := range prog.Inst {
+		if inst.Op == syntax.InstEmptyWidth && syntax.EmptyOp(inst.Arg)&(syntax.EmptyWordBoundary|syntax.EmptyNoWordBoundary) != 0 {
+			return nil, fmt.Errorf("invalid pattern: word boundaries are not supported")
+		}
+	}
+	d := &patternDFA{prog: prog, charOK: charOK, ids: map[string]int{}}
+	for _, c := range chars {
+		d.runes = append(d.runes, []rune(c)[0])
+	}
+	start := map[uint32]bool{}
+	d.closure(start, uint32(prog.Start), true, false)
+	if _, err := d.intern(start, true); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// closure adds pc and every instruction reachable from it without reading
+// a character. End-of-text checks are kept pending until accepts.
+func (d *patternDFA) closure(set map[uint32]bool, pc uint32, atStart, atEnd bool) {
+	if set[pc] {
+		return
+	}
+	inst := d.prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		set[pc] = true
+		d.closure(set, inst.Out, atStart, atEnd)
+		d.closure(set, inst.Arg, atStart, atEnd)
+	case syntax.InstCapture, syntax.InstNop:
+		set[pc] = true
+		d.closure(set, inst.Out, atStart, atEnd)
+	case syntax.InstEmptyWidth:
+		op := syntax.EmptyOp(inst.Arg)
+		if op&(syntax.EmptyBeginText|syntax.EmptyBeginLine) != 0 && !atStart {
+			return
+		}
+		set[pc] = true
+		if op&(syntax.EmptyEndText|syntax.EmptyEndLine) != 0 && !atEnd {
+			return // pending until the sample ends
+		}
+		d.closure(set, inst.Out, atStart, atEnd)
+	case syntax.InstFail:
+	default:
+		set[pc] = true
+	}
+}
+
+// intern returns the state id for set, creating it if needed.
+func (d *patternDFA) intern(set map[uint32]bool, atStart bool) (int, error) {
+	pcs := make([]uint32, 0, len(set))
+	for pc := range set {
+		pcs = append(pcs, pc)
+	}
+	sort.Slice(pcs, func(a, b int) bool { return pcs[a] < pcs[b] })
+	key := fmt.Sprint(atStart, pcs)
+	if id, ok := d.ids[key]; ok {
+		return id, nil
+	}
+	if len(d.sets) >= maxPatternStates {
+		return -1, fmt.Errorf("pattern is too complex (more than %d states)", maxPatternStates)
+	}
+	id := len(d.sets)
+	d.ids[key] = id
+	d.sets = append(d.sets, pcs)
+	trans := make([]int, len(d.runes))
+	for i := range trans {
+		trans[i] = -2
+	}
+	d.trans = append(d.trans, trans)
+	d.dist = append(d.dist, -1)
+
+	final := false
+	for _, pc := range pcs {
+		end := map[uint32]bool{}
+		d.closure(end, pc, atStart, true)
+		for endPC := range end {
+			if d.prog.Inst[endPC].Op == syntax.InstMatch {
+				final = true
+			}
+		}
+	}
+	d.finals = append(d.finals, final)
+	return id, nil
+}
+
+// step is the state after reading char token id, or -1 if the pattern can
+// no longer match (or the state limit was hit).
+func (d *patternDFA) step(state, id int) int {
+	if next := d.trans[state][id]; next != -2 {
+		return next
+	}
+	r := d.runes[id]
+	set := map[uint32]bool{}
+	for _, pc := range d.sets[state] {
+		inst := d.prog.Inst[pc]
+		matched := false
+		switch inst.Op {
+		case syntax.InstRune:
+			matched = inst.MatchRune(r)
+		case syntax.InstRune1:
+			matched = r == inst.Rune[0]
+		case syntax.InstRuneAny:
+			matched = true
+		case syntax.InstRuneAnyNotNL:
+			matched = r != '\n'
+		}
+		if matched {
+			d.closure(set, inst.Out, false, false)
+		}
+	}
+	next := -1
+	if len(set) > 0 {
+		if id, err := d.intern(set, false); err == nil {
+			next = id
+		}
+	}
+	d.trans[state][id] = next
+	return next
+}
+
+func (d *patternDFA) accepts(state int) bool {
+	return d.finals[state]
+}
+
+// distance is the fewest allowed characters that take state to acceptance
+// (a large number if it never can), found by breadth-first search.
+func (d *patternDFA) distance(state int) int {
+	if d.dist[state] >= 0 {
+		return d.dist[state]
+	}
+	const unreachable = 1 << 30
+	depth := map[int]int{state: 0}
+	queue := []int{state}
+	result := unreachable
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if d.accepts(s) {
+			result = depth[s]
+			break
+		}
+		for id := range d.runes {
+			if !d.charOK[id] {
+				continue
+			}
+			next := d.step(s, id)
+			if _, seen := depth[next]; next >= 0 && !seen {
+				depth[next] = depth[s] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	d.dist[state] = result
+	return result
+}
+
+// maskedReason is the trace sentence about masked candidates ("" if none).
+func maskedReason(masked []MaskedCandidate, maskedProb float64) string {
+	if len(masked) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(
+		" Constraints masked %.4f of the model's probability; most likely masked option was '%s' (%s).",
+		maskedProb, masked[0].Char, masked[0].Reason,
+	)
+}
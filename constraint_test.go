@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestConstrainedSamplesMatchPattern(t *testing.T) {
+	rand.Seed(1)
+	m := newTestModel(t, Config{})
+	for _, pattern := range []string{"[a-e][lmnor]{2,4}e?", "(bob|zoe)+", "a.*z", "[^a]{3}"} {
+		re := regexp.MustCompile("^(?:" + pattern + ")$")
+		opts := GenerateOptions{Pattern: pattern, BannedChars: "d", Temperature: 1, TopK: 5, MinLen: 3}
+		for i := 0; i < 200; i++ {
+			text, err := GenerateSample(m, opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trace, err := GenerateSampleWithTrace(m, opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range []string{text, trace.Text} {
+				if !re.MatchString(s) {
+					t.Fatalf("pattern %q: sample %q does not match", pattern, s)
+				}
+				if strings.Contains(s, "d") {
+					t.Fatalf("pattern %q: sample %q contains banned 'd'", pattern, s)
+				}
+			}
+		}
+	}
+}
+
+func TestConstraintErrors(t *testing.T) {
+	m := newTestModel(t, Config{})
+	for name, opts := range map[string]GenerateOptions{
+		"word boundary":   {Pattern: `a\b`},
+		"bad syntax":      {Pattern: "a(b"},
+		"unknown allowed": {AllowedChars: "A"},
+		"unknown banned":  {BannedChars: "!"},
+		"too long":        {Pattern: "a{20}"},
+		"all banned":      {Pattern: "bob", BannedChars: "o"},
+	} {
+		if _, err := newConstraint(m, opts, m.Config.BlockSize); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if _, err := GenerateSample(m, opts, nil); err == nil {
+			t.Errorf("%s: GenerateSample should return the constraint error", name)
+		}
+	}
+}
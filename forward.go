@@ -3,89 +3,261 @@ package main
 import (
 	"fmt"
 	"math"
+	"sync"
 )
 
 // Forward runs one autoregressive step:
 // it consumes a single token + position and returns logits for next token.
 //
-// keys/values are KV caches, one per layer, that store past sequence state.
-// This allows current token to attend to earlier tokens.
-func (m *Model) Forward(tokenID, posID int, keys, values [][][]*Value) []*Value {
-	// Embed token and position, then add them.
-	tokEmb := m.State["wte"][tokenID]
-	posEmb := m.State["wpe"][posID]
-	x := make([]*Value, m.Config.NEmpd)
-	for i := 0; i < m.Config.NEmpd; i++ {
-		x[i] = tokEmb[i].Add(posEmb[i])
-	}
-	x = m.RMSNorm(x)
+// cache holds past sequence state (see KVCache), so the current token can
+// attend to earlier tokens; this step's keys/values are appended to it.
+// posID must be cache.Next(), and below block_size for learned positions.
+func (m *Model) Forward(tokenID, posID int, cache *KVCache[*Value]) ([]*Value, error) {
+	return m.forward(tokenID, posID, cache, nil, nil)
+}
 
-	headDim := m.Config.NEmpd / m.Config.NHead
+// forward is Forward with optional training-time dropout on the embeddings,
+// attention weights and both residual branches (nil = no dropout), and
+// optional inspection hooks that record or edit activations (nil = off).
+func (m *Model) forward(tokenID, posID int, cache *KVCache[*Value], drop *dropout, hooks *forwardHooks) ([]*Value, error) {
+	if err := cache.checkNext(m.Config, posID); err != nil {
+		return nil, err
+	}
+	x := m.embed(tokenID, posID, drop, hooks)
+	cache.makeRoom()
 
 	// Process each transformer layer.
+	// Pre-norm normalizes each block's input; post-norm normalizes after the residual add.
 	for li := 0; li < m.Config.NLayer; li++ {
-		// -------- Attention block --------
-		xResidual := x
-		x = m.RMSNorm(x)
-
-		q := m.Linear(x, m.State[fmt.Sprintf("layer%d.attn_wq", li)])
-		k := m.Linear(x, m.State[fmt.Sprintf("layer%d.attn_wk", li)])
-		v := m.Linear(x, m.State[fmt.Sprintf("layer%d.attn_wv", li)])
-		keys[li] = append(keys[li], k)
-		values[li] = append(values[li], v)
-
-		xAttn := make([]*Value, 0, m.Config.NEmpd)
-
-		// Multi-head attention:
-		// each head looks at a slice of embedding dimensions.
-		for h := 0; h < m.Config.NHead; h++ {
-			hs := h * headDim
-			qH := q[hs : hs+headDim]
-
-			// Score each past position with q·k/sqrt(d).
-			attnLogits := make([]*Value, len(keys[li]))
-			for t := 0; t < len(keys[li]); t++ {
-				dot := NewValue(0)
-				kH := keys[li][t][hs : hs+headDim]
-				for j := 0; j < headDim; j++ {
-					dot = dot.Add(qH[j].Mul(kH[j]))
-				}
-				attnLogits[t] = dot.Mul(NewValue(1.0 / math.Sqrt(float64(headDim))))
-			}
-			attnWeights := m.Softmax(attnLogits)
+		q, k, v := m.attnProject(li, posID, x)
+		keys, values := cache.add(li, k, v)
+		x = m.attnOutput(li, x, q, keys, values, drop, hooks)
+		x = m.mlpBlock(li, x, drop, hooks)
+	}
+	return m.output(x), nil
+}
 
-			// Weighted sum of value vectors.
-			headOut := make([]*Value, headDim)
-			for j := 0; j < headDim; j++ {
-				sum := NewValue(0)
-				for t := 0; t < len(values[li]); t++ {
-					vH := values[li][t][hs : hs+headDim]
-					sum = sum.Add(attnWeights[t].Mul(vH[j]))
-				}
-				headOut[j] = sum
+// ForwardBatch runs whole sequences at once and returns logits for every
+// position: out[b][t] are the next-token logits after reading tokens[b][:t+1].
+//
+// Rows may have different lengths. Instead of growing a KV cache token by
+// token, each layer projects q/k/v for all positions first, then position t
+// attends to positions 0..t only (the causal mask: no peeking at the future).
+// The numbers are identical to calling Forward position by position
+// (see forward_test.go).
+//
+// All rows form one graph over the same parameters, so training builds one
+// graph per batch and runs a single Backward per step (see batchLoss).
+func (m *Model) ForwardBatch(tokens [][]int) ([][][]*Value, error) {
+	return m.forwardBatch(tokens, nil, 1)
+}
+
+// forwardBatch is ForwardBatch with per-row dropout (drops[b] for row b; a
+// nil slice means no dropout). Rows never read each other, so up to workers
+// goroutines build them in parallel; they only read the parameters, and the
+// graph is the same for any worker count.
+func (m *Model) forwardBatch(tokens [][]int, drops []*dropout, workers int) ([][][]*Value, error) {
+	if err := checkBatch(m.Config, tokens); err != nil {
+		return nil, err
+	}
+	out := make([][][]*Value, len(tokens))
+	row := func(b int) {
+		var drop *dropout
+		if drops != nil {
+			drop = drops[b]
+		}
+		out[b] = m.forwardRow(tokens[b], drop)
+	}
+	if workers <= 1 {
+		for b := range tokens {
+			row(b)
+		}
+		return out, nil
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for b := w; b < len(tokens); b += workers {
+				row(b)
 			}
-			xAttn = append(xAttn, headOut...)
+		}(w)
+	}
+	wg.Wait()
+	return out, nil
+}
+
+// forwardRow runs one row of forwardBatch, layer by layer.
+func (m *Model) forwardRow(row []int, drop *dropout) [][]*Value {
+	xs := make([][]*Value, len(row))
+	for t, tokenID := range row {
+		xs[t] = m.embed(tokenID, t, drop, nil)
+	}
+
+	n := len(xs)
+	for li := 0; li < m.Config.NLayer; li++ {
+		qs := make([][]*Value, n)
+		keys := make([][]*Value, n)
+		values := make([][]*Value, n)
+		for t, x := range xs {
+			qs[t], keys[t], values[t] = m.attnProject(li, t, x)
 		}
+		for t, x := range xs {
+			x = m.attnOutput(li, x, qs[t], keys[:t+1], values[:t+1], drop, nil)
+			xs[t] = m.mlpBlock(li, x, drop, nil)
+		}
+	}
 
-		// Project concatenated heads back to embedding size + residual connection.
-		x = m.Linear(xAttn, m.State[fmt.Sprintf("layer%d.attn_wo", li)])
-		for i := range x {
-			x[i] = x[i].Add(xResidual[i])
+	out := make([][]*Value, n)
+	for t, x := range xs {
+		out[t] = m.output(x)
+	}
+	return out
+}
+
+// checkBatch rejects rows that ForwardBatch cannot run: with learned
+// positions, a row may be at most block_size tokens long.
+func checkBatch(cfg Config, tokens [][]int) error {
+	if cfg.positionEncoding() != PositionLearned {
+		return nil
+	}
+	for b, row := range tokens {
+		if len(row) > cfg.BlockSize {
+			return fmt.Errorf("row %d has %d tokens, past block_size %d (learned position embeddings)", b, len(row), cfg.BlockSize)
 		}
+	}
+	return nil
+}
+
+// embed builds the residual stream's starting vector for one token.
+func (m *Model) embed(tokenID, posID int, drop *dropout, hooks *forwardHooks) []*Value {
+	// Embed token and (for additive schemes) position, then add them.
+	// rope and alibi inject position inside attention instead.
+	tokEmb := m.State["wte"][tokenID]
+	x := make([]*Value, m.Config.NEmpd)
+	switch m.Config.positionEncoding() {
+	case PositionLearned:
+		posEmb := m.State["wpe"][posID]
+		for i := 0; i < m.Config.NEmpd; i++ {
+			x[i] = tokEmb[i].Add(posEmb[i])
+		}
+	case PositionSinusoidal:
+		posEmb := sinusoidalEncoding(posID, m.Config.NEmpd)
+		for i := 0; i < m.Config.NEmpd; i++ {
+			x[i] = tokEmb[i].Add(NewValue(posEmb[i]))
+		}
+	default:
+		copy(x, tokEmb)
+	}
+	x = hooks.atValues(hookSite{Name: "input"}, x)
+	x = drop.apply(x)
+	x = m.normalize(x, "emb_norm")
+	return hooks.atValues(hookSite{Name: "embed"}, x)
+}
 
-		// -------- MLP block --------
-		xResidual = x
-		x = m.RMSNorm(x)
-		x = m.Linear(x, m.State[fmt.Sprintf("layer%d.mlp_fc1", li)])
-		for i := range x {
-			x[i] = x[i].Relu()
+// attnProject computes one position's query, key and value for layer li.
+func (m *Model) attnProject(li, posID int, x []*Value) (q, k, v []*Value) {
+	if m.Config.normPlacement() != NormPost {
+		x = m.normalize(x, fmt.Sprintf("layer%d.attn_norm", li))
+	}
+	q = m.Linear(x, m.State[fmt.Sprintf("layer%d.attn_wq", li)])
+	k = m.Linear(x, m.State[fmt.Sprintf("layer%d.attn_wk", li)])
+	v = m.Linear(x, m.State[fmt.Sprintf("layer%d.attn_wv", li)])
+	if m.Config.positionEncoding() == PositionRoPE {
+		// Keys are cached already rotated for their own position.
+		headDim := m.Config.headDim()
+		q = ropeValues(q, headDim, posID)
+		k = ropeValues(k, headDim, posID)
+	}
+	return q, k, v
+}
+
+// attnOutput lets query q attend over keys/values (every position it may
+// see, itself last), then projects the heads back and adds the residual.
+func (m *Model) attnOutput(li int, xResidual, q []*Value, keys, values [][]*Value, drop *dropout, hooks *forwardHooks) []*Value {
+	headDim := m.Config.headDim()
+	xAttn := make([]*Value, 0, m.Config.NEmpd)
+
+	// Multi-head attention:
+	// each head looks at a slice of embedding dimensions.
+	for h := 0; h < m.Config.NHead; h++ {
+		hs := h * headDim
+		qH := q[hs : hs+headDim]
+		// K/V slice of the (possibly shared) key/value head.
+		kvs := m.Config.kvHeadFor(h) * headDim
+
+		// Score each past position with q·k/sqrt(d).
+		attnLogits := make([]*Value, len(keys))
+		for t := 0; t < len(keys); t++ {
+			dot := NewValue(0)
+			kH := keys[t][kvs : kvs+headDim]
+			for j := 0; j < headDim; j++ {
+				dot = dot.Add(qH[j].Mul(kH[j]))
+			}
+			attnLogits[t] = dot.Mul(NewValue(1.0 / math.Sqrt(float64(headDim))))
+			if m.Config.positionEncoding() == PositionALiBi {
+				// Penalize by distance back from the current token.
+				distance := len(keys) - 1 - t
+				attnLogits[t] = attnLogits[t].Add(NewValue(-alibiSlope(h, m.Config.NHead) * float64(distance)))
+			}
 		}
-		x = m.Linear(x, m.State[fmt.Sprintf("layer%d.mlp_fc2", li)])
-		for i := range x {
-			x[i] = x[i].Add(xResidual[i])
+		attnWeights := drop.apply(m.Softmax(attnLogits))
+
+		// Weighted sum of value vectors.
+		headOut := make([]*Value, headDim)
+		for j := 0; j < headDim; j++ {
+			sum := NewValue(0)
+			for t := 0; t < len(values); t++ {
+				vH := values[t][kvs : kvs+headDim]
+				sum = sum.Add(attnWeights[t].Mul(vH[j]))
+			}
+			headOut[j] = sum
 		}
+		headOut = hooks.atValues(hookSite{Name: "head", Layer: li, Head: h}, headOut)
+		xAttn = append(xAttn, headOut...)
 	}
 
-	// Convert final hidden vector to logits over vocabulary.
+	// Project concatenated heads back to embedding size + residual connection.
+	x := drop.apply(m.Linear(xAttn, m.State[fmt.Sprintf("layer%d.attn_wo", li)]))
+	x = hooks.atValues(hookSite{Name: "attn_out", Layer: li}, x)
+	for i := range x {
+		x[i] = x[i].Add(xResidual[i])
+	}
+	if m.Config.normPlacement() == NormPost {
+		x = m.normalize(x, fmt.Sprintf("layer%d.attn_norm", li))
+	}
+	return hooks.atValues(hookSite{Name: "after_attn", Layer: li}, x)
+}
+
+// mlpBlock is the position-wise feed-forward block with its residual.
+func (m *Model) mlpBlock(li int, x []*Value, drop *dropout, hooks *forwardHooks) []*Value {
+	postNorm := m.Config.normPlacement() == NormPost
+	xResidual := x
+	if !postNorm {
+		x = m.normalize(x, fmt.Sprintf("layer%d.mlp_norm", li))
+	}
+	x = m.Linear(x, m.State[fmt.Sprintf("layer%d.mlp_fc1", li)])
+	for i := range x {
+		x[i] = x[i].Relu()
+	}
+	x = hooks.atValues(hookSite{Name: "mlp_relu", Layer: li}, x)
+	x = drop.apply(m.Linear(x, m.State[fmt.Sprintf("layer%d.mlp_fc2", li)]))
+	x = hooks.atValues(hookSite{Name: "mlp_out", Layer: li}, x)
+	for i := range x {
+		x[i] = x[i].Add(xResidual[i])
+	}
+	if postNorm {
+		x = m.normalize(x, fmt.Sprintf("layer%d.mlp_norm", li))
+	}
+	return hooks.atValues(hookSite{Name: "after_mlp", Layer: li}, x)
+}
+
+// output applies the optional final norm and converts the hidden vector
+// to logits over the vocabulary.
+func (m *Model) output(x []*Value) []*Value {
+	if m.Config.FinalNorm {
+		x = m.normalize(x, "final_norm")
+	}
 	return m.Linear(x, m.State["lm_head"])
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// InferenceModel is a read-only float64 copy of a Model's weights.
+//
+// Why a second forward pass?
+// - Model.Forward builds a full Value graph so Backward can run later.
+// - Generation and scoring never call Backward, so recording graph links is waste.
+// - This copy runs the exact same arithmetic on plain float64 numbers.
+//
+// The operation order mirrors forward.go step by step, so logits are
+// numerically identical to the graph path. The explicit float64(a*b)
+// conversions below stop the compiler from fusing a*b+c into one FMA
+// instruction, which the graph path (one node per operation) never does.
+type InferenceModel struct {
+	Config    Config
+	VocabSize int
+	Chars     []string
+	BOS       int
+	Weights   map[string][][]float64
+}
+
+// Inference snapshots the current parameter values into an InferenceModel.
+//
+// Callers should hold model.mu so the snapshot is not taken mid-update.
+func (m *Model) Inference() *InferenceModel {
+	weights := make(map[string][][]float64, len(m.State))
+	for name, mat := range m.State {
+		rows := make([][]float64, len(mat))
+		for i, row := range mat {
+			rows[i] = make([]float64, len(row))
+			for j, v := range row {
+				rows[i][j] = v.Data
+			}
+		}
+		weights[name] = rows
+	}
+	return &InferenceModel{
+		Config:    m.Config,
+		VocabSize: m.VocabSize,
+		Chars:     m.Chars,
+		BOS:       m.BOS,
+		Weights:   weights,
+	}
+}
+
+// Forward runs one autoregressive step without building a computation graph.
+//
+// cache is a float64 KVCache with the same rules as Model.Forward's.
+func (im *InferenceModel) Forward(tokenID, posID int, cache *KVCache[float64]) ([]float64, error) {
+	return im.forward(tokenID, posID, cache, nil)
+}
+
+// forward is Forward with optional inspection hooks (nil = off).
+func (im *InferenceModel) forward(tokenID, posID int, cache *KVCache[float64], hooks *forwardHooks) ([]float64, error) {
+	if err := cache.checkNext(im.Config, posID); err != nil {
+		return nil, err
+	}
+	x := im.embed(tokenID, posID, hooks)
+	cache.makeRoom()
+	for li := 0; li < im.Config.NLayer; li++ {
+		q, k, v := im.attnProject(li, posID, x)
+		keys, values := cache.add(li, k, v)
+		x = im.attnOutput(li, x, q, keys, values, hooks)
+		x = im.mlpBlock(li, x, hooks)
+	}
+	return im.output(x), nil
+}
+
+// ForwardBatch is the float64 twin of Model.ForwardBatch: logits for every
+// position of every row, computed layer by layer with a causal mask.
+func (im *InferenceModel) ForwardBatch(tokens [][]int) ([][][]float64, error) {
+	if err := checkBatch(im.Config, tokens); err != nil {
+		return nil, err
+	}
+	xs := make([][][]float64, len(tokens))
+	for b, row := range tokens {
+		xs[b] = make([][]float64, len(row))
+		for t, tokenID := range row {
+			xs[b][t] = im.embed(tokenID, t, nil)
+		}
+	}
+
+	for li := 0; li < im.Config.NLayer; li++ {
+		for b := range xs {
+			n := len(xs[b])
+			qs := make([][]float64, n)
+			keys := make([][]float64, n)
+			values := make([][]float64, n)
+			for t, x := range xs[b] {
+				qs[t], keys[t], values[t] = im.attnProject(li, t, x)
+			}
+			for t, x := range xs[b] {
+				x = im.attnOutput(li, x, qs[t], keys[:t+1], values[:t+1], nil)
+				xs[b][t] = im.mlpBlock(li, x, nil)
+			}
+		}
+	}
+
+	out := make([][][]float64, len(xs))
+	for b := range xs {
+		out[b] = make([][]float64, len(xs[b]))
+		for t, x := range xs[b] {
+			out[b][t] = im.output(x)
+		}
+	}
+	return out, nil
+}
+
+// embed is the float64 twin of Model.embed.
+func (im *InferenceModel) embed(tokenID, posID int, hooks *forwardHooks) []float64 {
+	tokEmb := im.Weights["wte"][tokenID]
+	x := make([]float64, im.Config.NEmpd)
+	switch im.Config.positionEncoding() {
+	case PositionLearned:
+		posEmb := im.Weights["wpe"][posID]
+		for i := 0; i < im.Config.NEmpd; i++ {
+			x[i] = tokEmb[i] + posEmb[i]
+		}
+	case PositionSinusoidal:
+		posEmb := sinusoidalEncoding(posID, im.Config.NEmpd)
+		for i := 0; i < im.Config.NEmpd; i++ {
+			x[i] = tokEmb[i] + posEmb[i]
+		}
+	default:
+		copy(x, tokEmb)
+	}
+	x = hooks.at(hookSite{Name: "input"}, x)
+	x = im.normalize(x, "emb_norm")
+	return hooks.at(hookSite{Name: "embed"}, x)
+}
+
+// attnProject is the float64 twin of Model.attnProject.
+func (im *InferenceModel) attnProject(li, posID int, x []float64) (q, k, v []float64) {
+	if im.Config.normPlacement() != NormPost {
+		x = im.normalize(x, fmt.Sprintf("layer%d.attn_norm", li))
+	}
+	q = linearData(x, im.Weights[fmt.Sprintf("layer%d.attn_wq", li)])
+	k = linearData(x, im.Weights[fmt.Sprintf("layer%d.attn_wk", li)])
+	v = linearData(x, im.Weights[fmt.Sprintf("layer%d.attn_wv", li)])
+	if im.Config.positionEncoding() == PositionRoPE {
+		headDim := im.Config.headDim()
+		q = ropeData(q, headDim, posID)
+		k = ropeData(k, headDim, posID)
+	}
+	return q, k, v
+}
+
+// attnOutput is the float64 twin of Model.attnOutput.
+func (im *InferenceModel) attnOutput(li int, xResidual, q []float64, keys, values [][]float64, hooks *forwardHooks) []float64 {
+	headDim := im.Config.headDim()
+	scale := 1.0 / math.Sqrt(float64(headDim))
+	xAttn := make([]float64, 0, im.Config.NEmpd)
+	for h := 0; h < im.Config.NHead; h++ {
+		hs := h * headDim
+		qH := q[hs : hs+headDim]
+		// K/V slice of the (possibly shared) key/value head.
+		kvs := im.Config.kvHeadFor(h) * headDim
+
+		attnLogits := make([]float64, len(keys))
+		for t := 0; t < len(keys); t++ {
+			dot := 0.0
+			kH := keys[t][kvs : kvs+headDim]
+			for j := 0; j < headDim; j++ {
+				dot += float64(qH[j] * kH[j])
+			}
+			attnLogits[t] = float64(dot * scale)
+			if im.Config.positionEncoding() == PositionALiBi {
+				distance := len(keys) - 1 - t
+				attnLogits[t] += -alibiSlope(h, im.Config.NHead) * float64(distance)
+			}
+		}
+		attnWeights := softmaxData(attnLogits)
+
+		headOut := make([]float64, headDim)
+		for j := 0; j < headDim; j++ {
+			sum := 0.0
+			for t := 0; t < len(values); t++ {
+				sum += float64(attnWeights[t] * values[t][kvs+j])
+			}
+			headOut[j] = sum
+		}
+		headOut = hooks.at(hookSite{Name: "head", Layer: li, Head: h}, headOut)
+		xAttn = append(xAttn, headOut...)
+	}
+
+	x := linearData(xAttn, im.Weights[fmt.Sprintf("layer%d.attn_wo", li)])
+	x = hooks.at(hookSite{Name: "attn_out", Layer: li}, x)
+	for i := range x {
+		x[i] += xResidual[i]
+	}
+	if im.Config.normPlacement() == NormPost {
+		x = im.normalize(x, fmt.Sprintf("layer%d.attn_norm", li))
+	}
+	return hooks.at(hookSite{Name: "after_attn", Layer: li}, x)
+}
+
+// mlpBlock is the float64 twin of Model.mlpBlock.
+func (im *InferenceModel) mlpBlock(li int, x []float64, hooks *forwardHooks) []float64 {
+	postNorm := im.Config.normPlacement() == NormPost
+	xResidual := x
+	if !postNorm {
+		x = im.normalize(x, fmt.Sprintf("layer%d.mlp_norm", li))
+	}
+	x = linearData(x, im.Weights[fmt.Sprintf("layer%d.mlp_fc1", li)])
+	for i := range x {
+		x[i] = math.Max(0, x[i])
+	}
+	x = hooks.at(hookSite{Name: "mlp_relu", Layer: li}, x)
+	x = linearData(x, im.Weights[fmt.Sprintf("layer%d.mlp_fc2", li)])
+	x = hooks.at(hookSite{Name: "mlp_out", Layer: li}, x)
+	for i := range x {
+		x[i] += xResidual[i]
+	}
+	if postNorm {
+		x = im.normalize(x, fmt.Sprintf("layer%d.mlp_norm", li))
+	}
+	return hooks.at(hookSite{Name: "after_mlp", Layer: li}, x)
+}
+
+// output is the float64 twin of Model.output.
+func (im *InferenceModel) output(x []float64) []float64 {
+	if im.Config.FinalNorm {
+		x = im.normalize(x, "final_norm")
+	}
+	return linearData(x, im.Weights["lm_head"])
+}
+
+// linearData is the float64 twin of Model.Linear.
+func linearData(x []float64, w [][]float64) []float64 {
+	out := make([]float64, len(w))
+	for i, row := range w {
+		sum := 0.0
+		for j, xi := range x {
+			sum += float64(row[j] * xi)
+		}
+		out[i] = sum
+	}
+	return out
+}
+
+// softmaxData is the float64 twin of Model.Softmax.
+//
+// It keeps the same max-subtraction and reciprocal-multiply order
+// so results match the graph path bit for bit.
+func softmaxData(logits []float64) []float64 {
+	maxVal := -math.MaxFloat64
+	for _, l := range logits {
+		if l > maxVal {
+			maxVal = l
+		}
+	}
+
+	exps := make([]float64, len(logits))
+	total := 0.0
+	for i, l := range logits {
+		exps[i] = math.Exp(l + -maxVal)
+		total += exps[i]
+	}
+
+	invTotal := math.Pow(total, -1)
+	for i := range exps {
+		exps[i] *= invTotal
+	}
+	return exps
+}
+
+// rmsNormData is the float64 twin of Model.RMSNorm.
+func rmsNormData(x []float64) []float64 {
+	sumSq := 0.0
+	for _, xi := range x {
+		sumSq += float64(xi * xi)
+	}
+	ms := float64(sumSq * (1.0 / float64(len(x))))
+	scale := math.Pow(ms+1e-5, -0.5)
+
+	out := make([]float64, len(x))
+	for i, xi := range x {
+		out[i] = xi * scale
+	}
+	return out
+}
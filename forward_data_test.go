@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+var testDocs = []string{"anna", "bob", "carla", "dave", "emma", "zoe"}
+
+// newTestModel builds a model for cfg and scrambles every parameter (norm
+// gains and biases included), so no term in the forward pass is a no-op.
+func newTestModel(t testing.TB, cfg Config) *Model {
+	t.Helper()
+	if cfg.NEmpd == 0 {
+		cfg.NEmpd, cfg.NHead, cfg.NLayer, cfg.BlockSize = 8, 2, 2, 8
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+	m := NewModel(cfg, testDocs)
+	rng := rand.New(rand.NewSource(1))
+	for _, p := range m.Params {
+		p.Data = rng.NormFloat64() * 0.5
+	}
+	return m
+}
+
+// forwardConfigs covers every branch of the forward pass.
+var forwardConfigs = map[string]Config{
+	"learned":        {},
+	"sinusoidal":     {PositionEncoding: PositionSinusoidal},
+	"rope":           {PositionEncoding: PositionRoPE},
+	"alibi":          {PositionEncoding: PositionALiBi},
+	"layernorm":      {Norm: NormLayer},
+	"no norm":        {Norm: NormNone},
+	"post norm":      {NormPlacement: NormPost, FinalNorm: true},
+	"gqa":            {NEmpd: 8, NHead: 4, NKVHead: 2, NLayer: 2, BlockSize: 8},
+	"multi-query":    {NEmpd: 8, NHead: 4, NKVHead: 1, NLayer: 2, BlockSize: 8, PositionEncoding: PositionRoPE},
+	"tied":           {TieEmbeddings: true},
+	"tied final rms": {TieEmbeddings: true, FinalNorm: true, PositionEncoding: PositionALiBi},
+}
+
+func TestInferenceForwardMatchesGraph(t *testing.T) {
+	for name, cfg := range forwardConfigs {
+		t.Run(name, func(t *testing.T) {
+			m := newTestModel(t, cfg)
+			im := m.Inference()
+			tokens := encodeDoc("carla", m.Chars, m.BOS)
+			cache := m.NewKVCache()
+			imCache := im.NewKVCache()
+			for pos, tokenID := range tokens[:len(tokens)-1] {
+				want, err := m.Forward(tokenID, pos, cache)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := im.Forward(tokenID, pos, imCache)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range want {
+					if got[i] != want[i].Data {
+						t.Fatalf("pos %d logit %d: float path %v, graph path %v", pos, i, got[i], want[i].Data)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestForwardRejectsBadPositions(t *testing.T) {
+	im := newTestModel(t, Config{}).Inference()
+	cache := im.NewKVCache()
+	if _, err := im.Forward(im.BOS, 1, cache); err == nil {
+		t.Fatal("expected an error for a position that skips ahead of the cache")
+	}
+	for pos := 0; pos < im.Config.BlockSize; pos++ {
+		if _, err := im.Forward(im.BOS, pos, cache); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := im.Forward(im.BOS, im.Config.BlockSize, cache); err == nil {
+		t.Fatal("expected an error past block_size with learned positions")
+	}
+}
+
+// benchConfig is big enough for the graph overhead to show.
+var benchConfig = Config{NEmpd: 16, NHead: 4, NLayer: 2, BlockSize: 16}
+
+// BenchmarkGenerate generates block_size tokens greedily, building a full
+// autograd graph ("graph") or running the float64 InferenceModel ("float").
+func BenchmarkGenerate(b *testing.B) {
+	m := newTestModel(b, benchConfig)
+	b.Run("graph", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			cache := m.NewKVCache()
+			tokenID := m.BOS
+			for pos := 0; pos < m.Config.BlockSize; pos++ {
+				logits, err := m.Forward(tokenID, pos, cache)
+				if err != nil {
+					b.Fatal(err)
+				}
+				tokenID = argmax(valuesData(logits))
+			}
+		}
+	})
+	b.Run("float", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			im := m.Inference()
+			cache := im.NewKVCache()
+			tokenID := im.BOS
+			for pos := 0; pos < im.Config.BlockSize; pos++ {
+				logits, err := im.Forward(tokenID, pos, cache)
+				if err != nil {
+					b.Fatal(err)
+				}
+				tokenID = argmax(logits)
+			}
+		}
+	})
+}
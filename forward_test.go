@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+var batchDocs = []string{"carla", "bo", "emmazoeda"}
+
+// batchRows encodes batchDocs, capped like training at block_size inputs
+// plus the last target. The rows have different lengths.
+func batchRows(m *Model) [][]int {
+	rows := [][]int{}
+	for _, doc := range batchDocs {
+		tokens := encodeDoc(doc, m.Chars, m.BOS)
+		if len(tokens) > m.Config.BlockSize+1 {
+			tokens = tokens[:m.Config.BlockSize+1]
+		}
+		rows = append(rows, tokens)
+	}
+	return rows
+}
+
+func TestForwardBatchMatchesForward(t *testing.T) {
+	for name, cfg := range forwardConfigs {
+		t.Run(name, func(t *testing.T) {
+			m := newTestModel(t, cfg)
+			rows := [][]int{}
+			for _, tokens := range batchRows(m) {
+				rows = append(rows, tokens[:len(tokens)-1])
+			}
+			batch, err := m.ForwardBatch(rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			floatBatch, err := m.Inference().ForwardBatch(rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for b, row := range rows {
+				cache := m.NewKVCache()
+				for pos, tokenID := range row {
+					want, err := m.Forward(tokenID, pos, cache)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for i := range want {
+						if batch[b][pos][i].Data != want[i].Data {
+							t.Fatalf("row %d pos %d logit %d: batch %v, incremental %v", b, pos, i, batch[b][pos][i].Data, want[i].Data)
+						}
+						if floatBatch[b][pos][i] != want[i].Data {
+							t.Fatalf("row %d pos %d logit %d: float batch %v, incremental %v", b, pos, i, floatBatch[b][pos][i], want[i].Data)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// incrementalLoss builds the batch loss token by token through a KV cache,
+// combining positions and examples in the same order as batchLoss, and
+// returns the loss and gradient.
+func incrementalLoss(t *testing.T, m *Model, examples []trainExample) (float64, []float64) {
+	t.Helper()
+	total := NewValue(0)
+	for _, ex := range examples {
+		cache := m.NewKVCache()
+		exampleLoss := NewValue(0)
+		for pos, tokenID := range ex.inputs {
+			logits, err := m.Forward(tokenID, pos, cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			probs := m.Softmax(logits)
+			exampleLoss = exampleLoss.Add(probs[ex.targets[pos]].Log().Mul(NewValue(-1)))
+		}
+		total = total.Add(exampleLoss.Mul(NewValue(1.0 / float64(len(ex.inputs)))))
+	}
+	loss := total.Mul(NewValue(1.0 / float64(len(examples))))
+	return loss.Data, backwardGrads(m, loss)
+}
+
+// backwardGrads runs Backward from loss on zeroed gradients and copies them out.
+func backwardGrads(m *Model, loss *Value) []float64 {
+	for _, p := range m.Params {
+		p.Grad = 0
+	}
+	loss.Backward()
+	grads := make([]float64, len(m.Params))
+	for i, p := range m.Params {
+		grads[i] = p.Grad
+	}
+	return grads
+}
+
+func TestBatchedLossMatchesIncremental(t *testing.T) {
+	for name, cfg := range forwardConfigs {
+		t.Run(name, func(t *testing.T) {
+			m := newTestModel(t, cfg)
+			examples := []trainExample{}
+			for _, tokens := range batchRows(m) {
+				examples = append(examples, trainExample{inputs: tokens[:len(tokens)-1], targets: tokens[1:]})
+			}
+			wantLoss, wantGrads := incrementalLoss(t, m, examples)
+			for _, workers := range []int{1, 2} {
+				loss, _, err := batchLoss(m, examples, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if loss.Data != wantLoss {
+					t.Fatalf("workers=%d: batched loss %v, incremental %v", workers, loss.Data, wantLoss)
+				}
+				grads := backwardGrads(m, loss)
+				for i := range wantGrads {
+					if grads[i] != wantGrads[i] {
+						t.Fatalf("workers=%d param %d: batched grad %v, incremental %v", workers, i, grads[i], wantGrads[i])
+					}
+				}
+			}
+
+			// evalLoss scores the same docs on the float path, averaging
+			// per-doc losses, so it matches up to rounding.
+			got, err := evalLoss(m.Inference(), batchDocs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-wantLoss) > 1e-12 {
+				t.Fatalf("evalLoss %v, incremental %v", got, wantLoss)
+			}
+		})
+	}
+}
+
+func TestForwardBatchRejectsLongRows(t *testing.T) {
+	for name, cfg := range forwardConfigs {
+		t.Run(name, func(t *testing.T) {
+			m := newTestModel(t, cfg)
+			long := make([]int, m.Config.BlockSize+1)
+			rows := [][]int{{m.BOS}, long}
+			_, err := m.ForwardBatch(rows)
+			_, floatErr := m.Inference().ForwardBatch(rows)
+			if m.Config.positionEncoding() == PositionLearned {
+				if err == nil || floatErr == nil {
+					t.Fatalf("expected errors past block_size with learned positions, got %v and %v", err, floatErr)
+				}
+				return
+			}
+			if err != nil || floatErr != nil {
+				t.Fatalf("%s positions should run past block_size, got %v and %v", m.Config.positionEncoding(), err, floatErr)
+			}
+		})
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
 	"sort"
 	"strings"
+	"time"
 )
 
 // tokenLabel converts token IDs to human-readable labels.
@@ -61,9 +63,14 @@ func sampleFromProbVector(probs []float64, fallbackTokenID int) (chosen int, u,
 			cumAfter = cumulative
 			return
 		}
+		if p > 0 {
+			// Remember the last possible token for the rounding fallback.
+			chosen, chosenProb, cumBefore = idx, p, prev
+		}
 	}
 
-	// If numerical issues prevented selection, return final interval.
+	// If numerical issues prevented selection (the probabilities summed to
+	// slightly less than u), return the final interval.
 	cumAfter = cumulative
 	return
 }
@@ -93,79 +100,126 @@ func topKCandidates(logits, probs []float64, chars []string, bos, k int) []Trace
 	return out
 }
 
-// trainOneExample computes one training loss and backpropagates gradients.
+// trainExample is one pre-drawn batch item: its tokens and dropout seed.
+type trainExample struct {
+	inputs  []int
+	targets []int
+	seed    int64
+}
+
+// trainBatch computes the mean loss over batchSize random examples and
+// leaves the batch-averaged gradient in Params' Grad fields.
 //
-// It does not update parameters by itself.
-func trainOneExample(model *Model, docs []string) (TrainResponse, error) {
-	doc := docs[rand.Intn(len(docs))]
-	tokens := encodeDoc(doc, model.Chars, model.BOS)
-
-	n := len(tokens) - 1
-	if n > model.Config.BlockSize {
-		n = model.Config.BlockSize
-	}
-	if n <= 0 {
-		return TrainResponse{}, fmt.Errorf("training sequence is empty")
-	}
-
-	keys := make([][][]*Value, model.Config.NLayer)
-	values := make([][][]*Value, model.Config.NLayer)
-	losses := []*Value{}
-	contextChar := "<END>"
-	targetChar := "<END>"
-	predictedChar := "<END>"
-	targetProb := 0.0
-	predictedProb := 0.0
-
-	// Teacher forcing:
-	// - feed current token
-	// - train to predict next token
-	for pos := 0; pos < n; pos++ {
-		logits := model.Forward(tokens[pos], pos, keys, values)
-		probs := model.Softmax(logits)
-		loss := probs[tokens[pos+1]].Log().Mul(NewValue(-1))
-		losses = append(losses, loss)
-
-		// Record final position diagnostics for UI.
-		if pos == n-1 {
-			bestIdx := 0
-			bestProb := probs[0].Data
-			for idx, p := range probs {
-				if p.Data > bestProb {
-					bestIdx = idx
-					bestProb = p.Data
-				}
-			}
-			contextChar = tokenLabel(tokens[pos], model.BOS, model.Chars)
-			targetChar = tokenLabel(tokens[pos+1], model.BOS, model.Chars)
-			predictedChar = tokenLabel(bestIdx, model.BOS, model.Chars)
-			targetProb = probs[tokens[pos+1]].Data
-			predictedProb = bestProb
+// How the work is split:
+// - rng pre-draws every example's doc and dropout seed, in batch order.
+// - The whole batch becomes one graph; workers build its rows in parallel.
+// - One Backward from the batch loss fills every parameter's gradient.
+//
+// The graph does not depend on the worker count, so workers=1 and
+// workers=8 give bit-identical results for the same rng.
+//
+// It does not update parameters by itself. This is the only place dropout is
+// active; generation and evalLoss always run in evaluation mode.
+func trainBatch(model *Model, docs []string, batchSize, workers int, rng *rand.Rand) (TrainResponse, error) {
+	examples := make([]trainExample, batchSize)
+	for b := range examples {
+		doc := docs[rng.Intn(len(docs))]
+		tokens := encodeDoc(doc, model.Chars, model.BOS)
+		n := len(tokens) - 1
+		if n > model.Config.BlockSize {
+			n = model.Config.BlockSize
 		}
+		if n <= 0 {
+			return TrainResponse{}, fmt.Errorf("training sequence is empty")
+		}
+		examples[b] = trainExample{inputs: tokens[:n], targets: tokens[1 : n+1], seed: rng.Int63()}
 	}
 
-	// Average loss over positions.
-	totalLoss := NewValue(0)
-	for _, l := range losses {
-		totalLoss = totalLoss.Add(l)
+	loss, logits, err := batchLoss(model, examples, trainWorkers(workers, batchSize))
+	if err != nil {
+		return TrainResponse{}, err
+	}
+	for _, p := range model.Params {
+		p.Grad = 0
 	}
-	avgLoss := totalLoss.Mul(NewValue(1.0 / float64(n)))
-	avgLoss.Backward()
+	graphNodes := loss.Backward()
+
+	// Final position of the last example, for the UI.
+	last := examples[batchSize-1]
+	pos := len(last.inputs) - 1
+	probs := softmaxData(valuesData(logits[batchSize-1][pos]))
+	best := argmax(probs)
+	target := last.targets[pos]
 
 	return TrainResponse{
 		Step:          model.Steps,
-		Loss:          avgLoss.Data,
-		ContextChar:   contextChar,
-		TargetChar:    targetChar,
-		PredictedChar: predictedChar,
-		TargetProb:    targetProb,
-		PredictedProb: predictedProb,
+		Loss:          loss.Data,
+		ContextChar:   tokenLabel(last.inputs[pos], model.BOS, model.Chars),
+		TargetChar:    tokenLabel(target, model.BOS, model.Chars),
+		PredictedChar: tokenLabel(best, model.BOS, model.Chars),
+		TargetProb:    probs[target],
+		PredictedProb: probs[best],
+		GraphNodes:    graphNodes,
 	}, nil
 }
 
-// TrainBatchedSteps runs multiple optimizer steps, each with gradient accumulation
-// over a mini-batch of random examples.
-func TrainBatchedSteps(model *Model, docs []string, stepsPerCall, batchSize int) (TrainResponse, error) {
+// trainWorkers clamps a requested worker count to 1..batchSize and to the
+// CPUs Go may use; more goroutines than CPUs would only add overhead.
+func trainWorkers(workers, batchSize int) int {
+	if procs := runtime.GOMAXPROCS(0); workers > procs {
+		workers = procs
+	}
+	if workers > batchSize {
+		workers = batchSize
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// batchLoss builds one graph for the whole batch: each example's loss is
+// averaged over its positions, then the examples are averaged in batch
+// order. It also returns the logits of every example.
+func batchLoss(model *Model, examples []trainExample, workers int) (*Value, [][][]*Value, error) {
+	rows := make([][]int, len(examples))
+	drops := make([]*dropout, len(examples))
+	for b, ex := range examples {
+		rows[b] = ex.inputs
+		drops[b] = newDropout(model.Config.Dropout, rand.New(rand.NewSource(ex.seed)))
+	}
+	logits, err := model.forwardBatch(rows, drops, workers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	total := NewValue(0)
+	for b, ex := range examples {
+		exampleLoss := NewValue(0)
+		for t := range logits[b] {
+			probs := model.Softmax(logits[b][t])
+			exampleLoss = exampleLoss.Add(probs[ex.targets[t]].Log().Mul(NewValue(-1)))
+		}
+		total = total.Add(exampleLoss.Mul(NewValue(1.0 / float64(len(logits[b])))))
+	}
+	return total.Mul(NewValue(1.0 / float64(len(examples)))), logits, nil
+}
+
+// valuesData copies the numbers out of graph nodes.
+func valuesData(x []*Value) []float64 {
+	out := make([]float64, len(x))
+	for i, v := range x {
+		out[i] = v.Data
+	}
+	return out
+}
+
+// TrainBatchedSteps runs multiple optimizer steps, each on the mean loss
+// of a mini-batch of random examples drawn from rng, computed by up to
+// workers goroutines (see trainBatch).
+//
+// Every step is appended to model.History (loss, learning rate, grad norm, timing).
+func TrainBatchedSteps(model *Model, docs []string, stepsPerCall, batchSize, workers int, rng *rand.Rand) (TrainResponse, error) {
 	if stepsPerCall < 1 {
 		stepsPerCall = 1
 	}
@@ -175,38 +229,90 @@ func TrainBatchedSteps(model *Model, docs []string, stepsPerCall, batchSize int)
 
 	lastResp := TrainResponse{}
 	avgLossAcrossSteps := 0.0
+	totalGraphNodes := 0
 
 	for step := 0; step < stepsPerCall; step++ {
-		// Ensure gradients are clean before accumulating batch gradients.
+		stepStart := time.Now()
+
+		// Ensure gradients are clean before backpropagating the batch.
 		for _, p := range model.Params {
 			p.Grad = 0
 		}
 
-		batchLoss := 0.0
-		for b := 0; b < batchSize; b++ {
-			docResp, err := trainOneExample(model, docs)
-			if err != nil {
-				return TrainResponse{}, err
-			}
-			batchLoss += docResp.Loss
-			lastResp = docResp
+		resp, err := trainBatch(model, docs, batchSize, workers, rng)
+		if err != nil {
+			return TrainResponse{}, err
 		}
+		stepLoss := resp.Loss
+		totalGraphNodes += resp.GraphNodes
+		lastResp = resp
 
-		// Scale gradients by batch size so update magnitude remains stable.
-		scale := 1.0 / float64(batchSize)
+		gradSq := 0.0
 		for _, p := range model.Params {
-			p.Grad *= scale
+			gradSq += p.Grad * p.Grad
 		}
 
 		model.Update()
-		avgLossAcrossSteps += batchLoss / float64(batchSize)
+		model.trackWeights()
+		avgLossAcrossSteps += stepLoss
+
+		finished := time.Now()
+		model.appendHistory(StepRecord{
+			Step:         model.Steps,
+			Loss:         stepLoss,
+			LearningRate: model.Config.LearningRate,
+			GradNorm:     math.Sqrt(gradSq),
+			BatchSize:    batchSize,
+			WallTime:     float64(finished.UnixNano()) / 1e9,
+			DurationMs:   float64(finished.Sub(stepStart).Microseconds()) / 1000,
+		})
 	}
 
 	lastResp.Step = model.Steps
 	lastResp.Loss = avgLossAcrossSteps / float64(stepsPerCall)
+	lastResp.GraphNodes = totalGraphNodes / stepsPerCall
 	return lastResp, nil
 }
 
+// evalLoss scores docs in evaluation mode (no dropout, no graph).
+//
+// Each doc's loss is its average next-token cross-entropy, exactly like the
+// training loss; the result is the mean over docs.
+func evalLoss(im *InferenceModel, docs []string) (float64, error) {
+	inputs := [][]int{}
+	targets := [][]int{}
+	for _, doc := range docs {
+		tokens := encodeDoc(doc, im.Chars, im.BOS)
+		n := len(tokens) - 1
+		if n > im.Config.BlockSize {
+			n = im.Config.BlockSize
+		}
+		if n <= 0 {
+			continue
+		}
+		inputs = append(inputs, tokens[:n])
+		targets = append(targets, tokens[1:n+1])
+	}
+	if len(inputs) == 0 {
+		return 0, nil
+	}
+
+	batch, err := im.ForwardBatch(inputs)
+	if err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for b, logits := range batch {
+		docLoss := 0.0
+		for t := range logits {
+			probs := softmaxData(logits[t])
+			docLoss += -math.Log(probs[targets[b][t]])
+		}
+		total += docLoss / float64(len(logits))
+	}
+	return total / float64(len(inputs)), nil
+}
+
 // samplingConfig returns validated generation defaults/options.
 func samplingConfig(opts GenerateOptions, vocabSize int) GenerateOptions {
 	if opts.Temperature <= 0 {
@@ -221,17 +327,65 @@ func samplingConfig(opts GenerateOptions, vocabSize int) GenerateOptions {
 	if opts.MinLen < 0 {
 		opts.MinLen = 0
 	}
+	if opts.KVWindow < 0 {
+		opts.KVWindow = 0
+	}
+	if opts.RepetitionPenalty <= 0 {
+		opts.RepetitionPenalty = 1
+	}
 	return opts
 }
 
+// applyPenalties discourages characters that are already in the sample,
+// so undertrained models loop less ("aaaa..."). counts[id] is how often
+// token id occurred so far. It returns logits itself when no penalty is set.
+//
+// Penalties:
+// - repetition_penalty r: a seen token's logit is divided by r (r > 1 lowers it).
+// - For negative logits it is multiplied by r instead, which also lowers it.
+// - frequency_penalty f: subtract f for every time the token appeared.
+// - presence_penalty p: subtract p once if the token appeared at all.
+func applyPenalties(logits []float64, opts GenerateOptions, counts []int) []float64 {
+	if opts.RepetitionPenalty == 1 && opts.FrequencyPenalty == 0 && opts.PresencePenalty == 0 {
+		return logits
+	}
+	out := append([]float64(nil), logits...)
+	for id, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if out[id] > 0 {
+			out[id] /= opts.RepetitionPenalty
+		} else {
+			out[id] *= opts.RepetitionPenalty
+		}
+		out[id] -= opts.FrequencyPenalty*float64(n) + opts.PresencePenalty
+	}
+	return out
+}
+
+// withPenaltyLogits fills in the before/after-penalty logits of candidates.
+func withPenaltyLogits(candidates []TraceCandidate, before, after []float64) []TraceCandidate {
+	for i := range candidates {
+		b, a := before[candidates[i].TokenID], after[candidates[i].TokenID]
+		candidates[i].LogitBeforePenalty, candidates[i].LogitAfterPenalty = &b, &a
+	}
+	return candidates
+}
+
 // toProbVector applies temperature, optional top-k filtering, and optional
 // temporary suppression of <END>, then returns final sampling probabilities.
-func toProbVector(logits []*Value, opts GenerateOptions, bosTokenID int, suppressEnd bool) ([]float64, []float64) {
+//
+// allowed (nil = everything) masks tokens a constraint forbids before top-k
+// is applied, so top-k picks among valid tokens only. <END> suppression
+// gives way when <END> is the only allowed token.
+func toProbVector(logits []float64, opts GenerateOptions, bosTokenID int, suppressEnd bool, allowed []bool) ([]float64, []float64) {
+	ok := func(i int) bool { return allowed == nil || allowed[i] }
 	raw := make([]float64, len(logits))
 	maxLogit := -math.MaxFloat64
 	for i := range logits {
-		raw[i] = logits[i].Data / opts.Temperature
-		if raw[i] > maxLogit {
+		raw[i] = logits[i] / opts.Temperature
+		if ok(i) && raw[i] > maxLogit {
 			maxLogit = raw[i]
 		}
 	}
@@ -239,6 +393,9 @@ func toProbVector(logits []*Value, opts GenerateOptions, bosTokenID int, suppres
 	probs := make([]float64, len(raw))
 	sumExp := 0.0
 	for i := range raw {
+		if !ok(i) {
+			continue
+		}
 		v := math.Exp(raw[i] - maxLogit)
 		probs[i] = v
 		sumExp += v
@@ -270,6 +427,15 @@ func toProbVector(logits []*Value, opts GenerateOptions, bosTokenID int, suppres
 		}
 	}
 
+	if suppressEnd && allowed != nil {
+		onlyEnd := true
+		for i := range allowed {
+			if allowed[i] && i != bosTokenID {
+				onlyEnd = false
+			}
+		}
+		suppressEnd = !onlyEnd
+	}
 	if suppressEnd && bosTokenID >= 0 && bosTokenID < len(probs) {
 		probs[bosTokenID] = 0
 	}
@@ -284,37 +450,53 @@ func toProbVector(logits []*Value, opts GenerateOptions, bosTokenID int, suppres
 			probs[i] /= sum
 		}
 	} else {
-		// Fallback: make distribution valid even in degenerate cases.
-		uniform := 1.0 / float64(len(probs))
+		// Fallback: make distribution valid even in degenerate cases,
+		// uniform over the tokens that are still permitted.
+		count := 0
 		for i := range probs {
-			probs[i] = uniform
-		}
-		if suppressEnd && len(probs) > 1 {
-			probs[bosTokenID] = 0
-			rest := 1.0 / float64(len(probs)-1)
-			for i := range probs {
-				if i != bosTokenID {
-					probs[i] = rest
-				}
+			if ok(i) && !(suppressEnd && i == bosTokenID) {
+				probs[i] = 1
+				count++
 			}
 		}
+		for i := range probs {
+			probs[i] /= float64(count)
+		}
 	}
 
 	return raw, probs
 }
 
 // GenerateSample creates one sampled text without detailed trace.
-func GenerateSample(model *Model, opts GenerateOptions) string {
+//
+// Sampling never needs gradients, so it runs on the graph-free InferenceModel
+// (frozen at opts.Precision). hooks (usually nil) can ablate components
+// while sampling. The error is an invalid constraint option (see
+// constraint.go) or a forward-pass position error (see KVCache.checkNext).
+func GenerateSample(model *Model, opts GenerateOptions, hooks *forwardHooks) (string, error) {
 	opts = samplingConfig(opts, model.VocabSize)
+	limit := generationLimit(model.Config, opts.MaxLen)
+	im := model.inferenceAt(opts.Precision)
 	tokenID := model.BOS
 	sample := []string{}
-	keys := make([][][]*Value, model.Config.NLayer)
-	values := make([][][]*Value, model.Config.NLayer)
+	cache := im.NewKVCache()
+	cache.Window = opts.KVWindow
+	constraint, err := newConstraint(model, opts, limit)
+	if err != nil {
+		return "", err
+	}
+	state := 0
+	counts := make([]int, model.VocabSize)
 
-	for pos := 0; pos < model.Config.BlockSize; pos++ {
-		logits := model.Forward(tokenID, pos, keys, values)
+	for pos := 0; pos < limit; pos++ {
+		modelLogits, err := im.forward(tokenID, pos, cache, hooks)
+		if err != nil {
+			return "", err
+		}
+		logits := applyPenalties(modelLogits, opts, counts)
 		suppressEnd := len(sample) < opts.MinLen
-		_, probs := toProbVector(logits, opts, model.BOS, suppressEnd)
+		allowed, _ := constraint.mask(state, len(sample))
+		_, probs := toProbVector(logits, opts, model.BOS, suppressEnd, allowed)
 		newTokenID, _, _, _, _ := sampleFromProbVector(probs, model.BOS)
 
 		if newTokenID == model.BOS {
@@ -323,36 +505,49 @@ func GenerateSample(model *Model, opts GenerateOptions) string {
 
 		sample = append(sample, model.Chars[newTokenID])
 		tokenID = newTokenID
+		state = constraint.next(state, newTokenID)
+		counts[newTokenID]++
 	}
 
-	return strings.Join(sample, "")
+	return strings.Join(sample, ""), nil
 }
 
 // GenerateSampleWithTrace creates sampled text and explains each choice.
-func GenerateSampleWithTrace(model *Model, opts GenerateOptions) GenerateTraceResponse {
+func GenerateSampleWithTrace(model *Model, opts GenerateOptions, hooks *forwardHooks) (GenerateTraceResponse, error) {
 	opts = samplingConfig(opts, model.VocabSize)
+	limit := generationLimit(model.Config, opts.MaxLen)
+	im := model.inferenceAt(opts.Precision)
 	tokenID := model.BOS
 	sample := []string{}
-	keys := make([][][]*Value, model.Config.NLayer)
-	values := make([][][]*Value, model.Config.NLayer)
+	cache := im.NewKVCache()
+	cache.Window = opts.KVWindow
+	constraint, err := newConstraint(model, opts, limit)
+	if err != nil {
+		return GenerateTraceResponse{}, err
+	}
+	state := 0
+	counts := make([]int, model.VocabSize)
 	steps := []TraceStep{}
 	stopReason := "Reached block size limit"
+	if limit != model.Config.BlockSize {
+		stopReason = fmt.Sprintf("Reached max length limit (%d)", limit)
+	}
 
-	for pos := 0; pos < model.Config.BlockSize; pos++ {
-		logits := model.Forward(tokenID, pos, keys, values)
+	for pos := 0; pos < limit; pos++ {
+		modelLogits, err := im.forward(tokenID, pos, cache, hooks)
+		if err != nil {
+			return GenerateTraceResponse{}, err
+		}
+		logits := applyPenalties(modelLogits, opts, counts)
 		suppressEnd := len(sample) < opts.MinLen
-		rawLogits, probs := toProbVector(logits, opts, model.BOS, suppressEnd)
-		topK := topKCandidates(rawLogits, probs, model.Chars, model.BOS, 5)
+		allowed, maskReasons := constraint.mask(state, len(sample))
+		rawLogits, probs := toProbVector(logits, opts, model.BOS, suppressEnd, allowed)
+		topK := withPenaltyLogits(topKCandidates(rawLogits, probs, model.Chars, model.BOS, 5), modelLogits, logits)
+		masked, maskedProb := maskedCandidates(rawLogits, maskReasons, model.Chars, model.BOS, 5)
 
 		newTokenID, rnd, cumBefore, cumAfter, chosenProb := sampleFromProbVector(probs, model.BOS)
 
-		chosenRank := len(probs)
-		for rank, cand := range topK {
-			if cand.TokenID == newTokenID {
-				chosenRank = rank + 1
-				break
-			}
-		}
+		chosenRank := candidateRank(topK, newTokenID, len(probs))
 
 		reason := fmt.Sprintf(
 			"Chosen '%s' because draw %.4f fell inside cumulative interval [%.4f, %.4f) in vocabulary index order.",
@@ -368,6 +563,7 @@ func GenerateSampleWithTrace(model *Model, opts GenerateOptions) GenerateTraceRe
 				topK[0].Prob,
 			)
 		}
+		reason += maskedReason(masked, maskedProb)
 
 		steps = append(steps, TraceStep{
 			Position:   pos,
@@ -380,6 +576,10 @@ func GenerateSampleWithTrace(model *Model, opts GenerateOptions) GenerateTraceRe
 			CumBefore:  cumBefore,
 			CumAfter:   cumAfter,
 			Reason:     reason,
+			CacheLen:   cache.Len(),
+			CacheBytes: cache.Bytes(),
+			Masked:     masked,
+			MaskedProb: maskedProb,
 		})
 
 		if newTokenID == model.BOS {
@@ -389,11 +589,70 @@ func GenerateSampleWithTrace(model *Model, opts GenerateOptions) GenerateTraceRe
 
 		sample = append(sample, model.Chars[newTokenID])
 		tokenID = newTokenID
+		state = constraint.next(state, newTokenID)
+		counts[newTokenID]++
 	}
 
 	return GenerateTraceResponse{
 		Text:       strings.Join(sample, ""),
 		Steps:      steps,
 		StopReason: stopReason,
+	}, nil
+}
+
+// History limits: once History holds maxHistory records, everything but the
+// newest recentHistory records is merged pairwise (see downsampleHistory),
+// so old steps lose resolution instead of memory growing without bound.
+const (
+	maxHistory    = 10000
+	recentHistory = 1000
+)
+
+// appendHistory logs one optimizer step, thinning old records past maxHistory.
+//
+// Callers must hold m.mu.
+func (m *Model) appendHistory(rec StepRecord) {
+	m.History = append(m.History, rec)
+	if len(m.History) <= maxHistory {
+		return
+	}
+	split := len(m.History) - recentHistory
+	older := downsampleHistory(m.History[:split], split/2)
+	m.History = append(older, m.History[split:]...)
+}
+
+// downsampleHistory reduces records to at most maxPoints by averaging
+// consecutive buckets.
+//
+// Within a bucket, Loss, GradNorm and DurationMs are averaged, while Step,
+// LearningRate, BatchSize and WallTime come from the bucket's last record,
+// so the final point always matches the latest step. ValLoss is the latest
+// validation measurement inside the bucket, if any.
+func downsampleHistory(records []StepRecord, maxPoints int) []StepRecord {
+	if maxPoints <= 0 || len(records) <= maxPoints {
+		return append([]StepRecord(nil), records...)
 	}
+	out := make([]StepRecord, 0, maxPoints)
+	for b := 0; b < maxPoints; b++ {
+		start := b * len(records) / maxPoints
+		end := (b + 1) * len(records) / maxPoints
+		bucket := records[start:end]
+
+		merged := bucket[len(bucket)-1]
+		merged.Loss, merged.GradNorm, merged.DurationMs = 0, 0, 0
+		for _, r := range bucket {
+			merged.Loss += r.Loss
+			merged.GradNorm += r.GradNorm
+			merged.DurationMs += r.DurationMs
+			if r.ValLoss != 0 {
+				merged.ValLoss = r.ValLoss
+			}
+		}
+		n := float64(len(bucket))
+		merged.Loss /= n
+		merged.GradNorm /= n
+		merged.DurationMs /= n
+		out = append(out, merged)
+	}
+	return out
 }
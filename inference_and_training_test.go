@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+func TestParallelTrainingMatchesSerial(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	cfg := Config{NEmpd: 8, NHead: 2, NLayer: 2, BlockSize: 8, LearningRate: 0.01, Dropout: 0.2}
+	serial := newTestModel(t, cfg)
+	parallel := newTestModel(t, cfg)
+
+	want, err := TrainBatchedSteps(serial, testDocs, 3, 6, 1, rand.New(rand.NewSource(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := TrainBatchedSteps(parallel, testDocs, 3, 6, 4, rand.New(rand.NewSource(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Loss != want.Loss {
+		t.Fatalf("loss with 4 workers %v, serial %v", got.Loss, want.Loss)
+	}
+	for i := range serial.Params {
+		if parallel.Params[i].Data != serial.Params[i].Data {
+			t.Fatalf("param %d with 4 workers %v, serial %v", i, parallel.Params[i].Data, serial.Params[i].Data)
+		}
+	}
+}
+
+func TestTrainWorkersCap(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	for _, c := range []struct{ workers, batchSize, want int }{
+		{0, 6, 1},
+		{3, 6, 3},
+		{8, 6, 4},
+		{5000, 5000, 4},
+		{4, 2, 2},
+	} {
+		if got := trainWorkers(c.workers, c.batchSize); got != c.want {
+			t.Errorf("trainWorkers(%d, %d) = %d, want %d", c.workers, c.batchSize, got, c.want)
+		}
+	}
+}
+
+func TestHistoryIsThinned(t *testing.T) {
+	m := &Model{}
+	for step := 1; step <= 3*maxHistory; step++ {
+		m.appendHistory(StepRecord{Step: step, Loss: 1})
+		if len(m.History) > maxHistory {
+			t.Fatalf("step %d: %d records, want at most %d", step, len(m.History), maxHistory)
+		}
+	}
+	recent := m.History[len(m.History)-recentHistory:]
+	for i, r := range recent {
+		if want := 3*maxHistory - recentHistory + 1 + i; r.Step != want {
+			t.Fatalf("recent record %d has step %d, want %d", i, r.Step, want)
+		}
+	}
+	for i := 1; i < len(m.History); i++ {
+		if m.History[i].Step <= m.History[i-1].Step {
+			t.Fatalf("steps out of order at %d: %d after %d", i, m.History[i].Step, m.History[i-1].Step)
+		}
+	}
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// This file contains read-only "look inside the model" endpoints.
+// Each handler copies what it needs under model.mu, then does the
+// (possibly slow) analysis without holding the lock.
+
+// handleInspectEmbeddings serves GET /api/inspect/embeddings.
+//
+// Query parameters:
+// - neighbors=K nearest neighbours per row by cosine similarity (default 3)
+// - tsne=1 also computes a t-SNE map (slower than PCA)
+// - perplexity=P t-SNE perplexity (default 5, clamped for tiny tables)
+func (s *Server) handleInspectEmbeddings(w http.ResponseWriter, r *http.Request) {
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	neighbors, err := queryInt(query.Get("neighbors"), 3)
+	if err != nil || neighbors < 0 {
+		http.Error(w, "invalid neighbors", http.StatusBadRequest)
+		return
+	}
+	withTSNE := query.Get("tsne") == "1" || query.Get("tsne") == "true"
+	perplexity := 5.0
+	if raw := query.Get("perplexity"); raw != "" {
+		if perplexity, err = strconv.ParseFloat(raw, 64); err != nil || perplexity <= 0 {
+			http.Error(w, "invalid perplexity", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.lockModel(model, "handleInspectEmbeddings")
+	im := model.Inference()
+	step := model.Steps
+	model.mu.Unlock()
+
+	tokenLabels := make([]string, im.VocabSize)
+	for i := range tokenLabels {
+		tokenLabels[i] = tokenLabel(i, im.BOS, im.Chars)
+	}
+	resp := EmbeddingsResponse{
+		Step:  step,
+		Token: buildEmbeddingTable("wte", im.Weights["wte"], tokenLabels, neighbors, withTSNE, perplexity),
+	}
+	if wpe, ok := im.Weights["wpe"]; ok {
+		posLabels := make([]string, len(wpe))
+		for i := range posLabels {
+			posLabels[i] = fmt.Sprintf("pos %d", i)
+		}
+		table := buildEmbeddingTable("wpe", wpe, posLabels, neighbors, withTSNE, perplexity)
+		resp.Position = &table
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectWeights serves GET /api/inspect/weights.
+//
+// Query parameters:
+// - bins=N histogram buckets per matrix (default 20)
+// - near_zero=T threshold for the near-zero fraction (default 1e-3)
+// - history=1 also returns the stats sampled during training
+func (s *Server) handleInspectWeights(w http.ResponseWriter, r *http.Request) {
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	bins, err := queryInt(query.Get("bins"), defaultHistogramBins)
+	if err != nil || bins < 1 || bins > 1000 {
+		http.Error(w, "invalid bins", http.StatusBadRequest)
+		return
+	}
+	nearZero := defaultNearZeroThreshold
+	if raw := query.Get("near_zero"); raw != "" {
+		if nearZero, err = strconv.ParseFloat(raw, 64); err != nil || nearZero < 0 {
+			http.Error(w, "invalid near_zero", http.StatusBadRequest)
+			return
+		}
+	}
+	withHistory := query.Get("history") == "1" || query.Get("history") == "true"
+
+	s.lockModel(model, "handleInspectWeights")
+	resp := WeightsResponse{
+		Step:              model.Steps,
+		NearZeroThreshold: nearZero,
+		Bins:              bins,
+		Matrices:          model.weightStats(bins, nearZero),
+	}
+	if withHistory {
+		resp.History = append([]WeightSnapshot(nil), model.weights...)
+	}
+	model.mu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectActivations serves POST /api/inspect/activations.
+//
+// It runs the text through the model once, recording the residual stream
+// after the embeddings and after every attention/MLP block, plus the MLP
+// neurons after ReLU, at each position.
+func (s *Server) handleInspectActivations(w http.ResponseWriter, r *http.Request) {
+	var req ActivationsRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.TopNeurons == 0 {
+		req.TopNeurons = 5
+	}
+	if req.TopNeurons < 0 {
+		http.Error(w, "top_neurons must be positive", http.StatusBadRequest)
+		return
+	}
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleInspectActivations")
+	im := model.Inference()
+	step := model.Steps
+	model.mu.Unlock()
+
+	tokens, err := inspectTokens(im, req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recs, err := captureActivations(im, tokens, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := ActivationsResponse{Step: step, Positions: make([]ActivationPosition, len(recs))}
+	for pos, rec := range recs {
+		label := tokenLabel(tokens[pos], im.BOS, im.Chars)
+		resp.Tokens = append(resp.Tokens, label)
+		p := ActivationPosition{Position: pos, Token: label, Embed: rec.vectors[hookSite{Name: "embed"}]}
+		for li := 0; li < im.Config.NLayer; li++ {
+			p.Layers = append(p.Layers, LayerActivations{
+				Layer:     li,
+				AfterAttn: rec.vectors[hookSite{Name: "after_attn", Layer: li}],
+				MLPRelu:   rec.vectors[hookSite{Name: "mlp_relu", Layer: li}],
+				AfterMLP:  rec.vectors[hookSite{Name: "after_mlp", Layer: li}],
+			})
+		}
+		resp.Positions[pos] = p
+	}
+	resp.NeuronsByChar = topNeuronsByChar(im, tokens, recs, req.TopNeurons)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectLogitLens serves POST /api/inspect/logit_lens.
+//
+// After every block it asks "if the model had to answer right now, what
+// would it say?" by sending the residual stream straight to lm_head. Watching the target's probability climb with depth shows
+// where each layer contributes to the prediction.
+func (s *Server) handleInspectLogitLens(w http.ResponseWriter, r *http.Request) {
+	var req LogitLensRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.TopK == 0 {
+		req.TopK = 5
+	}
+	if req.TopK < 0 {
+		http.Error(w, "top_k must be positive", http.StatusBadRequest)
+		return
+	}
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleInspectLogitLens")
+	im := model.Inference()
+	step := model.Steps
+	model.mu.Unlock()
+
+	tokens, err := inspectTokens(im, req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recs, err := captureActivations(im, tokens, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := LogitLensResponse{Step: step, FinalNorm: im.Config.FinalNorm, Positions: make([]LensPosition, len(recs))}
+	for pos, rec := range recs {
+		label := tokenLabel(tokens[pos], im.BOS, im.Chars)
+		target := tokens[pos+1]
+		resp.Tokens = append(resp.Tokens, label)
+		lp := LensPosition{Position: pos, Token: label, Target: tokenLabel(target, im.BOS, im.Chars)}
+		for _, depth := range lensDepths(im.Config) {
+			logits := decodeResidual(im, rec.vectors[depth])
+			probs := softmaxData(logits)
+			rank := 1
+			for _, p := range probs {
+				if p > probs[target] {
+					rank++
+				}
+			}
+			lp.Depths = append(lp.Depths, LensDepth{
+				Depth:      depth.String(),
+				Top:        topKCandidates(logits, probs, im.Chars, im.BOS, req.TopK),
+				TargetProb: probs[target],
+				TargetRank: rank,
+			})
+		}
+		resp.Positions[pos] = lp
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectAblate serves POST /api/inspect/ablate: it scores texts with
+// and without the requested ablations and reports the differences.
+func (s *Server) handleInspectAblate(w http.ResponseWriter, r *http.Request) {
+	var req AblateRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if len(req.Ablations) == 0 {
+		http.Error(w, "ablations must not be empty", http.StatusBadRequest)
+		return
+	}
+	model, docs := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleInspectAblate")
+	im := model.Inference()
+	step := model.Steps
+	model.mu.Unlock()
+
+	edits, err := ablationEdits(im, req.Ablations, docs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	texts := req.Texts
+	if len(texts) == 0 {
+		texts = docs
+		if len(texts) > 20 {
+			texts = texts[:20]
+		}
+	}
+
+	resp := AblateResponse{Step: step, Ablations: req.Ablations, Texts: make([]AblateText, 0, len(texts))}
+	for _, text := range texts {
+		tokens, err := inspectTokens(im, text)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := scoreText(im, text, tokens, edits)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.BaseLoss += result.BaseLoss / float64(len(texts))
+		resp.AblatedLoss += result.AblatedLoss / float64(len(texts))
+		resp.Texts = append(resp.Texts, result)
+	}
+	resp.DeltaLoss = resp.AblatedLoss - resp.BaseLoss
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectPatch serves POST /api/inspect/patch: activation patching
+// from a clean run into a corrupted run, swept over sites and positions.
+func (s *Server) handleInspectPatch(w http.ResponseWriter, r *http.Request) {
+	var req PatchRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleInspectPatch")
+	im := model.Inference()
+	step := model.Steps
+	model.mu.Unlock()
+
+	sites, err := patchSites(im.Config, req.Site)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clean, err := inspectTokens(im, req.Clean)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	corrupted, err := inspectTokens(im, req.Corrupted)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(clean) != len(corrupted) || len(clean) < 3 {
+		http.Error(w, "clean and corrupted must be non-empty and the same length", http.StatusBadRequest)
+		return
+	}
+
+	// The last position reads the last character and predicts what follows.
+	cleanRecs := make([]*forwardHooks, len(clean)-1)
+	cleanLogits, err := runSequence(im, clean, func(pos int) *forwardHooks {
+		cleanRecs[pos] = newRecorder()
+		return cleanRecs[pos]
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	last := len(cleanRecs) - 1
+	cleanProbs := softmaxData(cleanLogits[last])
+	target := argmax(cleanProbs)
+	if req.Target != "" {
+		if target, err = tokenByLabel(im, req.Target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	corruptedLogits, err := runSequence(im, corrupted, func(int) *forwardHooks { return nil })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	corruptedProbs := softmaxData(corruptedLogits[last])
+	rows, err := patchGrid(im, cleanRecs, corrupted, sites, target, cleanProbs[target], corruptedProbs[target])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Site == "" {
+		req.Site = "residual"
+	}
+	resp := PatchResponse{
+		Step:          step,
+		Site:          req.Site,
+		Target:        tokenLabel(target, im.BOS, im.Chars),
+		CleanProb:     cleanProbs[target],
+		CorruptedProb: corruptedProbs[target],
+		Rows:          rows,
+	}
+	for pos := range cleanRecs {
+		resp.CleanTokens = append(resp.CleanTokens, tokenLabel(clean[pos], im.BOS, im.Chars))
+		resp.CorruptedTokens = append(resp.CorruptedTokens, tokenLabel(corrupted[pos], im.BOS, im.Chars))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectSaliency serves POST /api/inspect/saliency: gradient-based
+// scores for how much each input character drove the next-character choice.
+func (s *Server) handleInspectSaliency(w http.ResponseWriter, r *http.Request) {
+	var req SaliencyRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleInspectSaliency")
+	clone := model.cloneParams()
+	im := model.Inference()
+	step := model.Steps
+	model.mu.Unlock()
+
+	tokens, err := inspectTokens(im, req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target := -1
+	if req.Target != "" {
+		if target, err = tokenByLabel(im, req.Target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	resp, err := saliency(clone, tokens, target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Step = step
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectKVCache serves POST /api/inspect/kv_cache: it reads text
+// through the float path and returns what the KV cache holds afterwards.
+func (s *Server) handleInspectKVCache(w http.ResponseWriter, r *http.Request) {
+	var req KVCacheRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.Window < 0 {
+		http.Error(w, "window must not be negative", http.StatusBadRequest)
+		return
+	}
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleInspectKVCache")
+	im := model.Inference()
+	step := model.Steps
+	model.mu.Unlock()
+
+	tokens, err := inspectTokens(im, req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tokens = tokens[:len(tokens)-1] // the closing BOS is never read
+	cache := im.NewKVCache()
+	cache.Window = req.Window
+	for pos, tokenID := range tokens {
+		if _, err := im.forward(tokenID, pos, cache, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := KVCacheResponse{
+		Step:   step,
+		Window: req.Window,
+		Start:  cache.Start,
+		Len:    cache.Len(),
+		Bytes:  cache.Bytes(),
+		Layers: make([]KVCacheLayer, im.Config.NLayer),
+	}
+	for _, tokenID := range tokens {
+		resp.Tokens = append(resp.Tokens, tokenLabel(tokenID, im.BOS, im.Chars))
+	}
+	for li := range resp.Layers {
+		layer := KVCacheLayer{Layer: li, Entries: make([]KVCacheEntry, cache.Len())}
+		for t := range layer.Entries {
+			pos := cache.Start + t
+			layer.Entries[t] = KVCacheEntry{
+				Position: pos,
+				Token:    resp.Tokens[pos],
+				Key:      cache.Keys[li][t],
+				Value:    cache.Values[li][t],
+			}
+		}
+		resp.Layers[li] = layer
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleInspectQuantization serves POST /api/inspect/quantization: it
+// scores weight-only float32 and int8 exports against float64.
+func (s *Server) handleInspectQuantization(w http.ResponseWriter, r *http.Request) {
+	var req QuantizationRequest
+	if err := s.decodeOptionalJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if req.MaxDocs < 0 {
+		http.Error(w, "max_docs must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.MaxDocs == 0 {
+		req.MaxDocs = defaultQuantizationDocs
+	}
+	model, docs := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleInspectQuantization")
+	im := model.Inference()
+	step := model.Steps
+	valueBytes := len(model.Params) * valueNodeBytes()
+	model.mu.Unlock()
+
+	var text []int
+	if req.Text != "" {
+		var err error
+		if text, err = inspectTokens(im, req.Text); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(docs) > req.MaxDocs {
+		docs = docs[:req.MaxDocs]
+	}
+	resp, err := compareQuantization(im, valueBytes, docs, text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Step = step
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// buildEmbeddingTable attaches projections and neighbour lists to raw rows.
+func buildEmbeddingTable(name string, rows [][]float64, labels []string, neighbors int, withTSNE bool, perplexity float64) EmbeddingTable {
+	pca, explained := pca2(rows)
+	var tsne [][2]float64
+	if withTSNE {
+		tsne = tsne2(rows, perplexity, 500)
+	}
+	nnIdx, nnSim := nearestNeighbors(rows, neighbors)
+
+	table := EmbeddingTable{Name: name, PCAExplained: explained, Points: make([]EmbeddingPoint, len(rows))}
+	for i, row := range rows {
+		point := EmbeddingPoint{
+			Label:     labels[i],
+			Index:     i,
+			Vector:    row,
+			PCA:       pca[i],
+			Neighbors: make([]EmbeddingNeighbor, len(nnIdx[i])),
+		}
+		if tsne != nil {
+			point.TSNE = &tsne[i]
+		}
+		for n, j := range nnIdx[i] {
+			point.Neighbors[n] = EmbeddingNeighbor{Label: labels[j], Index: j, Similarity: nnSim[i][n]}
+		}
+		table.Points[i] = point
+	}
+	return table
+}
+
+// handleModel serves GET /api/model: a summary of where the model's
+// capacity and compute go.
+func (s *Server) handleModel(w http.ResponseWriter, r *http.Request) {
+	model, _ := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	s.lockModel(model, "handleModel")
+	clone := model.cloneParams()
+	step := model.Steps
+	model.mu.Unlock()
+
+	resp, err := summarizeModel(clone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Steps = step
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// summarizeModel builds the /api/model response. It builds a full training
+// graph on m's parameters (see measureGraphNodes), so callers pass a
+// cloneParams copy rather than holding the live model's lock.
+func summarizeModel(m *Model) (ModelSummaryResponse, error) {
+	cfg := m.Config
+	d := cfg.NEmpd
+	kvDim := cfg.kvHeads() * cfg.headDim()
+
+	vocab := make([]string, m.VocabSize)
+	for i := range vocab {
+		vocab[i] = tokenLabel(i, m.BOS, m.Chars)
+	}
+
+	// Walk matrices in forward-pass order and group them by block.
+	groups := []ParamGroup{}
+	groupIdx := map[string]int{}
+	for _, name := range m.matrixNames() {
+		mat := m.State[name]
+		group, component := "embeddings", name
+		if strings.HasPrefix(name, "layer") {
+			dot := strings.Index(name, ".")
+			group, component = name[:dot], name[dot+1:]
+		} else if name == "lm_head" || strings.HasPrefix(name, "final_norm") {
+			group = "output"
+		}
+
+		info := MatrixInfo{Name: name, Component: component, Rows: len(mat), Cols: len(mat[0])}
+		info.Params = info.Rows * info.Cols
+		if name == "lm_head" && cfg.TieEmbeddings {
+			info.SharedWith = "wte"
+			info.Params = 0
+		}
+
+		idx, ok := groupIdx[group]
+		if !ok {
+			idx = len(groups)
+			groupIdx[group] = idx
+			groups = append(groups, ParamGroup{Name: group})
+		}
+		groups[idx].Matrices = append(groups[idx].Matrices, info)
+		groups[idx].Params += info.Params
+	}
+	for i := range groups {
+		groups[i].Percent = 100 * float64(groups[i].Params) / float64(len(m.Params))
+	}
+
+	// FLOPs: every Linear is rows*cols multiply-adds; attention at full context
+	// does q·k (head_dim per past token) and the weighted value sum per head.
+	matmul := 2 * m.VocabSize * d
+	for li := 0; li < cfg.NLayer; li++ {
+		for _, c := range []string{"attn_wq", "attn_wk", "attn_wv", "attn_wo", "mlp_fc1", "mlp_fc2"} {
+			mat := m.State[fmt.Sprintf("layer%d.%s", li, c)]
+			matmul += 2 * len(mat) * len(mat[0])
+		}
+	}
+	attention := cfg.NLayer * cfg.NHead * 4 * cfg.BlockSize * cfg.headDim()
+
+	kvPerToken := cfg.NLayer * 2 * kvDim
+	bytesPerNode := valueNodeBytes()
+
+	graphNodes, err := measureGraphNodes(m)
+	if err != nil {
+		return ModelSummaryResponse{}, err
+	}
+	const defaultBatchSize = 6
+
+	return ModelSummaryResponse{
+		Config:    cfg.withDefaults(),
+		Vocab:     vocab,
+		VocabSize: m.VocabSize,
+		Params:    len(m.Params),
+		Groups:    groups,
+		Attention: AttentionShape{
+			QueryHeads:    cfg.NHead,
+			KVHeads:       cfg.kvHeads(),
+			HeadDim:       cfg.headDim(),
+			QueriesPerKV:  cfg.NHead / cfg.kvHeads(),
+			KVDimPerLayer: kvDim,
+		},
+		MatmulFLOPs:    matmul,
+		AttentionFLOPs: attention,
+		FLOPsPerToken:  matmul + attention,
+		KVCache: KVCacheEstimate{
+			ValuesPerToken:  kvPerToken,
+			Positions:       cfg.BlockSize,
+			TotalValues:     kvPerToken * cfg.BlockSize,
+			Float64Bytes:    8 * kvPerToken * cfg.BlockSize,
+			ValueGraphBytes: bytesPerNode * kvPerToken * cfg.BlockSize,
+		},
+		Graph: GraphEstimate{
+			Positions:        cfg.BlockSize,
+			NodesPerExample:  graphNodes,
+			BytesPerNode:     bytesPerNode,
+			BytesPerExample:  graphNodes * bytesPerNode,
+			DefaultBatchSize: defaultBatchSize,
+			BytesPerStep:     graphNodes * bytesPerNode * defaultBatchSize,
+		},
+	}, nil
+}
+
+// matrixNames lists the model's State matrices in forward-pass order.
+func (m *Model) matrixNames() []string {
+	candidates := []string{"wte", "wpe", "emb_norm.gain", "emb_norm.bias"}
+	for li := 0; li < m.Config.NLayer; li++ {
+		for _, c := range []string{"attn_norm.gain", "attn_norm.bias", "attn_wq", "attn_wk", "attn_wv", "attn_wo",
+			"mlp_norm.gain", "mlp_norm.bias", "mlp_fc1", "mlp_fc2"} {
+			candidates = append(candidates, fmt.Sprintf("layer%d.%s", li, c))
+		}
+	}
+	candidates = append(candidates, "final_norm.gain", "final_norm.bias", "lm_head")
+
+	names := candidates[:0]
+	for _, name := range candidates {
+		if _, ok := m.State[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// valueNodeBytes approximates the heap cost of one autograd node: the Value
+// struct plus the backing arrays of a two-child Children/LocalGrads pair.
+func valueNodeBytes() int {
+	return int(unsafe.Sizeof(Value{})) + 2*int(unsafe.Sizeof(&Value{})) + 2*int(unsafe.Sizeof(float64(0)))
+}
+
+// measureGraphNodes builds (but never backpropagates) the loss graph for one
+// block_size-long training example and counts its nodes.
+func measureGraphNodes(m *Model) (int, error) {
+	cache := m.NewKVCache()
+	total := NewValue(0)
+	tokenID := m.BOS
+	for pos := 0; pos < m.Config.BlockSize; pos++ {
+		target := m.BOS
+		if len(m.Chars) > 0 {
+			target = pos % len(m.Chars)
+		}
+		logits, err := m.forward(tokenID, pos, cache, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		probs := m.Softmax(logits)
+		total = total.Add(probs[target].Log().Mul(NewValue(-1)))
+		tokenID = target
+	}
+	return len(total.Mul(NewValue(1.0 / float64(m.Config.BlockSize))).topoOrder()), nil
+}
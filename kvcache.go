@@ -0,0 +1,123 @@
+package main
+
+import "fmt"
+
+// KVCache is the attention memory of one sequence: every layer's key and
+// value vectors for the positions read so far. Each new token computes only
+// its own key and value and looks back at the rest, so the cache grows by
+// one entry per layer per token. Rollback forgets the newest entries (e.g.
+// rejected draft tokens); Window keeps only the most recent ones.
+//
+// T is *Value for the graph path (Model) and float64 for InferenceModel.
+// Entries are always a contiguous run of absolute positions Start..Next()-1,
+// so RoPE keys (rotated at their own position) and ALiBi distances stay valid
+// after old entries are dropped.
+type KVCache[T any] struct {
+	Keys   [][][]T // [layer][entry][kv dim], oldest entry first
+	Values [][][]T
+	Start  int // absolute position of entry 0
+	Window int // max entries kept per layer (0 = unlimited)
+
+	n         int // positions cached; kept apart from Keys so n_layer 0 works
+	elemBytes int // memory cost of one stored number
+}
+
+// NewKVCache returns an empty graph-path cache for m.
+func (m *Model) NewKVCache() *KVCache[*Value] {
+	return newKVCache[*Value](m.Config.NLayer, valueNodeBytes())
+}
+
+// NewKVCache returns an empty float64 cache for im.
+func (im *InferenceModel) NewKVCache() *KVCache[float64] {
+	return newKVCache[float64](im.Config.NLayer, 8)
+}
+
+func newKVCache[T any](nLayer, elemBytes int) *KVCache[T] {
+	return &KVCache[T]{
+		Keys:      make([][][]T, nLayer),
+		Values:    make([][][]T, nLayer),
+		elemBytes: elemBytes,
+	}
+}
+
+// Len is the number of positions currently cached.
+func (c *KVCache[T]) Len() int {
+	return c.n
+}
+
+// Next is the absolute position the next token must use.
+func (c *KVCache[T]) Next() int {
+	return c.Start + c.Len()
+}
+
+// Bytes is the memory held by the cached numbers. For the graph path this
+// counts each autograd node (see valueNodeBytes), not just its float.
+func (c *KVCache[T]) Bytes() int {
+	n := 0
+	for li := range c.Keys {
+		for t := range c.Keys[li] {
+			n += len(c.Keys[li][t]) + len(c.Values[li][t])
+		}
+	}
+	return n * c.elemBytes
+}
+
+// Rollback forgets every entry at absolute position pos or later, so the
+// next token is read at pos again.
+func (c *KVCache[T]) Rollback(pos int) error {
+	if pos < c.Start || pos > c.Next() {
+		return fmt.Errorf("cannot roll back to position %d: cache holds [%d, %d)", pos, c.Start, c.Next())
+	}
+	keep := pos - c.Start
+	for li := range c.Keys {
+		c.Keys[li] = c.Keys[li][:keep]
+		c.Values[li] = c.Values[li][:keep]
+	}
+	c.n = keep
+	return nil
+}
+
+// Truncate keeps only the newest n entries. Dropped entries are copied out
+// of the backing arrays so their memory can be freed.
+func (c *KVCache[T]) Truncate(n int) {
+	if n < 0 {
+		n = 0
+	}
+	drop := c.Len() - n
+	if drop <= 0 {
+		return
+	}
+	for li := range c.Keys {
+		c.Keys[li] = append([][]T(nil), c.Keys[li][drop:]...)
+		c.Values[li] = append([][]T(nil), c.Values[li][drop:]...)
+	}
+	c.Start += drop
+	c.n = n
+}
+
+// checkNext validates that posID may be appended under cfg.
+func (c *KVCache[T]) checkNext(cfg Config, posID int) error {
+	if posID != c.Next() {
+		return fmt.Errorf("position %d does not follow the cache (next position is %d)", posID, c.Next())
+	}
+	if cfg.positionEncoding() == PositionLearned && posID >= cfg.BlockSize {
+		return fmt.Errorf("position %d is past block_size %d (learned position embeddings)", posID, cfg.BlockSize)
+	}
+	return nil
+}
+
+// makeRoom counts one new position, first dropping the oldest entry when
+// the window is full. Each layer then appends its key and value with add.
+func (c *KVCache[T]) makeRoom() {
+	if c.Window > 0 && c.Len() >= c.Window {
+		c.Truncate(c.Window - 1)
+	}
+	c.n++
+}
+
+// add appends one layer's key and value and returns that layer's entries.
+func (c *KVCache[T]) add(li int, k, v []T) (keys, values [][]T) {
+	c.Keys[li] = append(c.Keys[li], k)
+	c.Values[li] = append(c.Values[li], v)
+	return c.Keys[li], c.Values[li]
+}
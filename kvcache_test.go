@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// readTokens feeds tokens into cache from its next position and returns the
+// logits after the last one.
+func readTokens(t *testing.T, im *InferenceModel, cache *KVCache[float64], tokens []int) []float64 {
+	t.Helper()
+	var logits []float64
+	for _, tokenID := range tokens {
+		var err error
+		if logits, err = im.Forward(tokenID, cache.Next(), cache); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return logits
+}
+
+func TestKVCacheRollbackAfterRejection(t *testing.T) {
+	for name, cfg := range forwardConfigs {
+		t.Run(name, func(t *testing.T) {
+			m := newTestModel(t, cfg)
+			im := m.Inference()
+			accepted := encodeDoc("car", m.Chars, m.BOS)[:3] // <BOS> c a
+			rejected := encodeDoc("bob", m.Chars, m.BOS)[1:4]
+			resampled := encodeDoc("la", m.Chars, m.BOS)[1:3]
+
+			cache := im.NewKVCache()
+			readTokens(t, im, cache, accepted)
+			readTokens(t, im, cache, rejected)
+			if err := cache.Rollback(len(accepted)); err != nil {
+				t.Fatal(err)
+			}
+			if cache.Len() != len(accepted) || cache.Next() != len(accepted) {
+				t.Fatalf("after rollback: len %d next %d, want %d", cache.Len(), cache.Next(), len(accepted))
+			}
+			got := readTokens(t, im, cache, resampled)
+
+			fresh := im.NewKVCache()
+			want := readTokens(t, im, fresh, append(append([]int(nil), accepted...), resampled...))
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("logit %d after rollback %v, fresh cache %v", i, got[i], want[i])
+				}
+			}
+			if cache.Bytes() != fresh.Bytes() {
+				t.Fatalf("bytes after rollback %d, fresh cache %d", cache.Bytes(), fresh.Bytes())
+			}
+		})
+	}
+
+	cache := newTestModel(t, Config{}).Inference().NewKVCache()
+	if err := cache.Rollback(1); err == nil {
+		t.Fatal("expected an error rolling back past the cached positions")
+	}
+}
+
+// With one layer and a relative position scheme, attention scores depend only
+// on token distances, so a sliding window at position t must give the same
+// logits as a fresh sequence made of the window's tokens.
+func TestKVCacheWindowKeepsRelativePositions(t *testing.T) {
+	const window = 4
+	for _, pe := range []string{PositionRoPE, PositionALiBi} {
+		t.Run(pe, func(t *testing.T) {
+			m := newTestModel(t, Config{NEmpd: 8, NHead: 2, NLayer: 1, BlockSize: 8, PositionEncoding: pe})
+			im := m.Inference()
+			tokens := encodeDoc("emmazoedave", m.Chars, m.BOS)
+
+			cache := im.NewKVCache()
+			cache.Window = window
+			for pos, tokenID := range tokens {
+				got, err := im.Forward(tokenID, pos, cache)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cache.Len() > window {
+					t.Fatalf("pos %d: %d entries, window is %d", pos, cache.Len(), window)
+				}
+				if start := pos + 1 - cache.Len(); cache.Start != start {
+					t.Fatalf("pos %d: start %d, want %d", pos, cache.Start, start)
+				}
+
+				first := pos + 1 - window
+				if first < 0 {
+					first = 0
+				}
+				want := readTokens(t, im, im.NewKVCache(), tokens[first:pos+1])
+				for i := range want {
+					if math.Abs(got[i]-want[i]) > 1e-9 {
+						t.Fatalf("pos %d logit %d: windowed %v, fresh window %v", pos, i, got[i], want[i])
+					}
+				}
+			}
+			if cache.Next() != len(tokens) {
+				t.Fatalf("next %d, want %d", cache.Next(), len(tokens))
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op on platforms without flock.
+// Atomic renames still protect the state file from torn writes.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
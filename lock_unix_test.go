@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import "testing"
+
+func TestOpenStoreIsExclusive(t *testing.T) {
+	dir := t.TempDir()
+	st := openTestStore(t, dir)
+	if second, err := OpenStore(dir); err == nil {
+		_ = second.Close()
+		t.Fatal("expected a second OpenStore on the same dir to fail")
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenStore(dir)
+	if err != nil {
+		t.Fatalf("OpenStore after Close: %v", err)
+	}
+	_ = reopened.Close()
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
+	"flag"
 	"io/fs"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -17,7 +24,57 @@ import (
 //go:embed web/*
 var webFS embed.FS
 
+// appConfig holds process-level settings.
+//
+// Every flag also has an ATOMIC_GPT_* environment variable so container
+// deployments can configure the server without changing the command line.
+// Flags win over environment variables.
+type appConfig struct {
+	Addr            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	TLSCert         string
+	TLSKey          string
+	MaxBodyBytes    int64
+	DataDir         string
+	Autosave        time.Duration
+}
+
+func parseFlags() appConfig {
+	var cfg appConfig
+	flag.StringVar(&cfg.Addr, "addr", envString("ATOMIC_GPT_ADDR", ":8080"),
+		"listen address (env ATOMIC_GPT_ADDR)")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", envDuration("ATOMIC_GPT_READ_TIMEOUT", 15*time.Second),
+		"max time to read a full request (env ATOMIC_GPT_READ_TIMEOUT)")
+	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", envDuration("ATOMIC_GPT_WRITE_TIMEOUT", 2*time.Minute),
+		"max time to handle a request and write its response (env ATOMIC_GPT_WRITE_TIMEOUT)")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", envDuration("ATOMIC_GPT_IDLE_TIMEOUT", 60*time.Second),
+		"max keep-alive idle time (env ATOMIC_GPT_IDLE_TIMEOUT)")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", envDuration("ATOMIC_GPT_SHUTDOWN_TIMEOUT", 30*time.Second),
+		"how long graceful shutdown waits for in-flight requests (env ATOMIC_GPT_SHUTDOWN_TIMEOUT)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", envString("ATOMIC_GPT_TLS_CERT", ""),
+		"TLS certificate file; enables HTTPS together with -tls-key (env ATOMIC_GPT_TLS_CERT)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", envString("ATOMIC_GPT_TLS_KEY", ""),
+		"TLS private key file (env ATOMIC_GPT_TLS_KEY)")
+	flag.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", envInt64("ATOMIC_GPT_MAX_BODY_BYTES", 1<<20),
+		"max JSON request body size in bytes (env ATOMIC_GPT_MAX_BODY_BYTES)")
+	flag.StringVar(&cfg.DataDir, "data-dir", envString("ATOMIC_GPT_DATA_DIR", ""),
+		"directory for persisted model/docs state (empty disables persistence; env ATOMIC_GPT_DATA_DIR)")
+	flag.DurationVar(&cfg.Autosave, "autosave", envDuration("ATOMIC_GPT_AUTOSAVE", 30*time.Second),
+		"how often to autosave state when -data-dir is set (env ATOMIC_GPT_AUTOSAVE)")
+	flag.Parse()
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		log.Fatalf("-tls-cert and -tls-key must be set together")
+	}
+	return cfg
+}
+
 func main() {
+	cfg := parseFlags()
+
 	// Seed random numbers once at program startup.
 	// We use randomness for parameter initialization and probabilistic sampling.
 	rand.Seed(time.Now().UnixNano())
@@ -28,10 +85,101 @@ func main() {
 	}
 
 	server := NewServer()
-	server.RegisterRoutes(http.DefaultServeMux, webRoot)
+	server.SetMaxBodyBytes(cfg.MaxBodyBytes)
+	if cfg.DataDir != "" {
+		store, err := OpenStore(cfg.DataDir)
+		if err != nil {
+			log.Fatalf("failed to open data dir: %v", err)
+		}
+		defer store.Close()
+		server.SetStore(store)
+		if err := server.RestoreState(); err != nil {
+			// Keep the unreadable file: the next save would replace it.
+			bad, moveErr := store.SetAside()
+			if moveErr != nil {
+				log.Fatalf("could not restore saved state (%v) and could not move it aside: %v", err, moveErr)
+			}
+			log.Printf("could not restore saved state, moved it to %s and starting fresh: %v", bad, err)
+		} else {
+			log.Printf("Persistence enabled in %s", cfg.DataDir)
+		}
+	}
+
+	mux := http.NewServeMux()
+	server.RegisterRoutes(mux, webRoot)
+
+	// SIGINT/SIGTERM trigger a graceful shutdown followed by a final save.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go server.RunAutosave(ctx.Done(), cfg.Autosave)
+
+	httpServer := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Println("Shutting down, waiting for in-flight requests...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
 
-	log.Println("Server starting on :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if cfg.TLSCert != "" {
+		log.Printf("Server starting on %s (TLS)...", cfg.Addr)
+		err = httpServer.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		log.Printf("Server starting on %s...", cfg.Addr)
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server crashed: %v", err)
 	}
+	// ListenAndServe returns as soon as Shutdown starts; wait for in-flight
+	// requests (e.g. a training call) to finish before the final save.
+	<-shutdownDone
+
+	if err := server.SaveState(true); err != nil {
+		log.Printf("final save failed: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// envString reads a string from the environment, or returns fallback.
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// envDuration reads a time.Duration from the environment, or returns fallback.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Printf("ignoring invalid %s=%q", key, v)
+	}
+	return fallback
+}
+
+// envInt64 reads an int64 from the environment, or returns fallback.
+func envInt64(key string, fallback int64) int64 {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+		log.Printf("ignoring invalid %s=%q", key, v)
+	}
+	return fallback
 }
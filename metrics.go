@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds (seconds) of the request latency histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects counters for GET /metrics in Prometheus text format.
+//
+// It is deliberately tiny and dependency-free: a mutex, a few maps,
+// and a hand-written exposition writer.
+type Metrics struct {
+	mu sync.Mutex
+
+	requests    map[requestKey]uint64
+	latency     map[string]*histogram
+	lockWait    map[string]float64
+	lockWaitCnt map[string]uint64
+
+	trainSteps        uint64
+	trainSeconds      float64
+	stepsPerSecond    float64
+	currentLoss       float64
+	graphNodesPerStep float64
+}
+
+type requestKey struct {
+	handler string
+	code    int
+}
+
+type histogram struct {
+	counts []uint64 // one per latencyBuckets entry, non-cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics creates an empty metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:    make(map[requestKey]uint64),
+		latency:     make(map[string]*histogram),
+		lockWait:    make(map[string]float64),
+		lockWaitCnt: make(map[string]uint64),
+	}
+}
+
+func (mt *Metrics) observeRequest(handler string, code int, elapsed time.Duration) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.requests[requestKey{handler, code}]++
+	h := mt.latency[handler]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		mt.latency[handler] = h
+	}
+	secs := elapsed.Seconds()
+	h.count++
+	h.sum += secs
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+func (mt *Metrics) observeLockWait(handler string, waited time.Duration) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.lockWait[handler] += waited.Seconds()
+	mt.lockWaitCnt[handler]++
+}
+
+// observeTraining records one /api/train call.
+func (mt *Metrics) observeTraining(steps int, elapsed time.Duration, loss float64, graphNodesPerStep int) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.trainSteps += uint64(steps)
+	mt.trainSeconds += elapsed.Seconds()
+	if elapsed > 0 {
+		mt.stepsPerSecond = float64(steps) / elapsed.Seconds()
+	}
+	mt.currentLoss = loss
+	mt.graphNodesPerStep = float64(graphNodesPerStep)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrument wraps a handler with request counting and latency timing.
+func (mt *Metrics) instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r)
+		mt.observeRequest(name, rec.code, time.Since(start))
+	}
+}
+
+// writePrometheus renders all metrics in the Prometheus text exposition format.
+func (mt *Metrics) writePrometheus(w io.Writer, paramCount int) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(mt.requests))
+	for k := range mt.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].code < keys[j].code
+	})
+	writeHeader(w, "atomicgpt_http_requests_total", "counter", "HTTP requests by handler and status code.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "atomicgpt_http_requests_total{handler=%q,code=\"%d\"} %d\n", k.handler, k.code, mt.requests[k])
+	}
+
+	writeHeader(w, "atomicgpt_http_request_duration_seconds", "histogram", "HTTP request latency by handler.")
+	for _, name := range sortedKeys(mt.latency) {
+		h := mt.latency[name]
+		cumulative := uint64(0)
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "atomicgpt_http_request_duration_seconds_bucket{handler=%q,le=%q} %d\n", name, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "atomicgpt_http_request_duration_seconds_bucket{handler=%q,le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "atomicgpt_http_request_duration_seconds_sum{handler=%q} %s\n", name, formatFloat(h.sum))
+		fmt.Fprintf(w, "atomicgpt_http_request_duration_seconds_count{handler=%q} %d\n", name, h.count)
+	}
+
+	writeHeader(w, "atomicgpt_model_lock_wait_seconds_total", "counter", "Time handlers spent waiting to acquire model.mu.")
+	for _, name := range sortedKeys(mt.lockWait) {
+		fmt.Fprintf(w, "atomicgpt_model_lock_wait_seconds_total{handler=%q} %s\n", name, formatFloat(mt.lockWait[name]))
+	}
+	writeHeader(w, "atomicgpt_model_lock_acquisitions_total", "counter", "Number of model.mu acquisitions by handler.")
+	for _, name := range sortedKeys(mt.lockWaitCnt) {
+		fmt.Fprintf(w, "atomicgpt_model_lock_acquisitions_total{handler=%q} %d\n", name, mt.lockWaitCnt[name])
+	}
+
+	writeHeader(w, "atomicgpt_train_steps_total", "counter", "Optimizer steps run since process start.")
+	fmt.Fprintf(w, "atomicgpt_train_steps_total %d\n", mt.trainSteps)
+	writeHeader(w, "atomicgpt_train_seconds_total", "counter", "Wall time spent inside training calls.")
+	fmt.Fprintf(w, "atomicgpt_train_seconds_total %s\n", formatFloat(mt.trainSeconds))
+	writeHeader(w, "atomicgpt_train_steps_per_second", "gauge", "Optimizer steps per second during the last training call.")
+	fmt.Fprintf(w, "atomicgpt_train_steps_per_second %s\n", formatFloat(mt.stepsPerSecond))
+	writeHeader(w, "atomicgpt_train_loss", "gauge", "Average loss reported by the last training call.")
+	fmt.Fprintf(w, "atomicgpt_train_loss %s\n", formatFloat(mt.currentLoss))
+	writeHeader(w, "atomicgpt_graph_nodes_per_step", "gauge", "Autograd Value nodes allocated per optimizer step in the last training call.")
+	fmt.Fprintf(w, "atomicgpt_graph_nodes_per_step %s\n", formatFloat(mt.graphNodesPerStep))
+	writeHeader(w, "atomicgpt_model_params", "gauge", "Trainable parameters in the active model.")
+	fmt.Fprintf(w, "atomicgpt_model_params %d\n", paramCount)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
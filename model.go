@@ -16,12 +16,105 @@ import (
 // - n_layer: number of stacked transformer blocks
 // - block_size: maximum sequence length processed in one pass
 // - learning_rate: step size for optimization
+// - tie_embeddings: reuse the token embedding table wte as the output head
+// - position_encoding: learned (default), sinusoidal, rope or alibi (see position.go)
+// - n_kv_head: key/value heads shared by groups of query heads (0 = n_head, 1 = multi-query)
+// - norm, norm_placement, final_norm: normalization type, placement and a final norm (see norm.go)
+// - dropout, weight_decay, l2: regularization against memorizing tiny datasets (see regularization.go)
 type Config struct {
-	NEmpd        int     `json:"n_embd"`
-	NHead        int     `json:"n_head"`
-	NLayer       int     `json:"n_layer"`
-	BlockSize    int     `json:"block_size"`
-	LearningRate float64 `json:"learning_rate"`
+	NEmpd            int     `json:"n_embd"`
+	NHead            int     `json:"n_head"`
+	NLayer           int     `json:"n_layer"`
+	BlockSize        int     `json:"block_size"`
+	LearningRate     float64 `json:"learning_rate"`
+	TieEmbeddings    bool    `json:"tie_embeddings,omitempty"`
+	PositionEncoding string  `json:"position_encoding,omitempty"`
+	NKVHead          int     `json:"n_kv_head,omitempty"`
+	Norm             string  `json:"norm,omitempty"`
+	NormPlacement    string  `json:"norm_placement,omitempty"`
+	FinalNorm        bool    `json:"final_norm,omitempty"`
+	Dropout          float64 `json:"dropout,omitempty"`
+	WeightDecay      float64 `json:"weight_decay,omitempty"`
+	L2               float64 `json:"l2,omitempty"`
+}
+
+// withDefaults fills optional fields with the values the model actually uses,
+// so API responses show e.g. "learned" instead of an empty string.
+func (c Config) withDefaults() Config {
+	c.PositionEncoding = c.positionEncoding()
+	c.NKVHead = c.kvHeads()
+	c.Norm = c.norm()
+	c.NormPlacement = c.normPlacement()
+	return c
+}
+
+// headDim is the size of one attention head.
+func (c Config) headDim() int {
+	return c.NEmpd / c.NHead
+}
+
+// kvHeads returns how many key/value heads each layer has.
+//
+// With grouped-query attention, query head h reads K/V head
+// h / (n_head / n_kv_head), so consecutive query heads share one K/V head.
+func (c Config) kvHeads() int {
+	if c.NKVHead <= 0 {
+		return c.NHead
+	}
+	return c.NKVHead
+}
+
+// kvHeadFor maps a query head to the K/V head it shares.
+func (c Config) kvHeadFor(h int) int {
+	return h / (c.NHead / c.kvHeads())
+}
+
+// Validate reports hyperparameter combinations the model cannot be built with.
+func (c Config) Validate() error {
+	switch {
+	case c.NEmpd <= 0:
+		return fmt.Errorf("n_embd must be positive")
+	case c.NHead <= 0:
+		return fmt.Errorf("n_head must be positive")
+	case c.NEmpd%c.NHead != 0:
+		return fmt.Errorf("n_embd (%d) must be divisible by n_head (%d)", c.NEmpd, c.NHead)
+	case c.NLayer < 0:
+		return fmt.Errorf("n_layer must not be negative")
+	case c.BlockSize <= 0:
+		return fmt.Errorf("block_size must be positive")
+	case c.NKVHead < 0 || c.NKVHead > c.NHead:
+		return fmt.Errorf("n_kv_head must be between 1 and n_head (%d)", c.NHead)
+	case c.NHead%c.kvHeads() != 0:
+		return fmt.Errorf("n_head (%d) must be divisible by n_kv_head (%d)", c.NHead, c.kvHeads())
+	}
+	switch c.positionEncoding() {
+	case PositionLearned, PositionSinusoidal, PositionALiBi:
+	case PositionRoPE:
+		if (c.NEmpd/c.NHead)%2 != 0 {
+			return fmt.Errorf("rope needs an even head size, got n_embd/n_head = %d", c.NEmpd/c.NHead)
+		}
+	default:
+		return fmt.Errorf("unknown position_encoding %q", c.PositionEncoding)
+	}
+	switch {
+	case c.Dropout < 0 || c.Dropout >= 1:
+		return fmt.Errorf("dropout must be in [0, 1)")
+	case c.WeightDecay < 0:
+		return fmt.Errorf("weight_decay must not be negative")
+	case c.L2 < 0:
+		return fmt.Errorf("l2 must not be negative")
+	}
+	switch c.norm() {
+	case NormRMS, NormLayer, NormNone:
+	default:
+		return fmt.Errorf("unknown norm %q", c.Norm)
+	}
+	switch c.normPlacement() {
+	case NormPre, NormPost:
+	default:
+		return fmt.Errorf("unknown norm_placement %q", c.NormPlacement)
+	}
+	return nil
 }
 
 // Model stores all trainable parameters and runtime state.
@@ -30,6 +123,7 @@ type Config struct {
 // - Params is a flat list so optimizer updates are easy.
 // - State keeps matrices by readable names (simple for learning/debugging).
 // - AdamM and AdamV store Adam optimizer moving averages.
+// - History logs optimizer steps (thinned past maxHistory) for the charts.
 // - mu protects model parameters from concurrent HTTP requests.
 type Model struct {
 	Config    Config
@@ -37,10 +131,15 @@ type Model struct {
 	Chars     []string
 	BOS       int
 	Params    []*Value
+	decay     []bool // decay[i]: Params[i] gets weight decay / L2 (norm gains/biases do not)
 	State     map[string][][]*Value
 	AdamM     []float64
 	AdamV     []float64
+	lastGrad  []float64 // gradient each param had at the last Update
 	Steps     int
+	History   []StepRecord
+	weights   []WeightSnapshot           // sampled per-matrix stats, see trackWeights
+	frozen    map[string]*InferenceModel // quantized copies by precision, see inferenceAt
 	mu        sync.Mutex
 }
 
@@ -64,6 +163,14 @@ func NewModel(config Config, docs []string) *Model {
 	}
 	sort.Strings(chars)
 
+	return newModelWithVocab(config, chars)
+}
+
+// newModelWithVocab initializes fresh weights for an already-known vocabulary.
+//
+// NewModel derives chars from docs; restoring a saved model reuses this
+// so Params end up in the same order as when the model was first built.
+func newModelWithVocab(config Config, chars []string) *Model {
 	vocabSize := len(chars) + 1
 	bos := len(chars)
 
@@ -85,32 +192,109 @@ func NewModel(config Config, docs []string) *Model {
 				val := NewValue(rand.NormFloat64() * 0.02)
 				mat[i][j] = val
 				m.Params = append(m.Params, val)
+				m.decay = append(m.decay, true)
 			}
 		}
 		return mat
 	}
 
-	// Token embedding, position embedding, and output projection.
+	// Learnable gain (and LayerNorm bias) for one normalization site.
+	createNorm := func(site string) {
+		if config.norm() == NormNone {
+			return
+		}
+		gain := [][]*Value{make([]*Value, config.NEmpd)}
+		for j := range gain[0] {
+			gain[0][j] = NewValue(1)
+			m.Params = append(m.Params, gain[0][j])
+			m.decay = append(m.decay, false)
+		}
+		m.State[site+".gain"] = gain
+		if config.norm() == NormLayer {
+			bias := [][]*Value{make([]*Value, config.NEmpd)}
+			for j := range bias[0] {
+				bias[0][j] = NewValue(0)
+				m.Params = append(m.Params, bias[0][j])
+				m.decay = append(m.decay, false)
+			}
+			m.State[site+".bias"] = bias
+		}
+	}
+
+	// Token embedding, (learned) position embedding, and output projection.
 	m.State["wte"] = createMatrix(vocabSize, config.NEmpd)
-	m.State["wpe"] = createMatrix(config.BlockSize, config.NEmpd)
-	m.State["lm_head"] = createMatrix(vocabSize, config.NEmpd)
+	if config.positionEncoding() == PositionLearned {
+		m.State["wpe"] = createMatrix(config.BlockSize, config.NEmpd)
+	}
+	if config.TieEmbeddings {
+		// Weight tying: the output head is the very same matrix of Values as wte.
+		// Both uses add into the same Grad fields during Backward, and the
+		// matrix is registered in Params only once.
+		m.State["lm_head"] = m.State["wte"]
+	} else {
+		m.State["lm_head"] = createMatrix(vocabSize, config.NEmpd)
+	}
+
+	createNorm("emb_norm")
 
 	// Per-layer matrices for attention and MLP.
+	// K/V projections only produce n_kv_head heads (smaller with GQA/MQA).
+	kvDim := config.kvHeads() * config.headDim()
 	for i := 0; i < config.NLayer; i++ {
 		m.State[fmt.Sprintf("layer%d.attn_wq", i)] = createMatrix(config.NEmpd, config.NEmpd)
-		m.State[fmt.Sprintf("layer%d.attn_wk", i)] = createMatrix(config.NEmpd, config.NEmpd)
-		m.State[fmt.Sprintf("layer%d.attn_wv", i)] = createMatrix(config.NEmpd, config.NEmpd)
+		m.State[fmt.Sprintf("layer%d.attn_wk", i)] = createMatrix(kvDim, config.NEmpd)
+		m.State[fmt.Sprintf("layer%d.attn_wv", i)] = createMatrix(kvDim, config.NEmpd)
 		m.State[fmt.Sprintf("layer%d.attn_wo", i)] = createMatrix(config.NEmpd, config.NEmpd)
 		m.State[fmt.Sprintf("layer%d.mlp_fc1", i)] = createMatrix(4*config.NEmpd, config.NEmpd)
 		m.State[fmt.Sprintf("layer%d.mlp_fc2", i)] = createMatrix(config.NEmpd, 4*config.NEmpd)
+		createNorm(fmt.Sprintf("layer%d.attn_norm", i))
+		createNorm(fmt.Sprintf("layer%d.mlp_norm", i))
+	}
+	if config.FinalNorm {
+		createNorm("final_norm")
 	}
 
 	m.AdamM = make([]float64, len(m.Params))
 	m.AdamV = make([]float64, len(m.Params))
+	m.lastGrad = make([]float64, len(m.Params))
 
 	return m
 }
 
+// cloneParams returns a model with the same config and vocabulary but its
+// own copy of every parameter leaf, so Backward on the copy never touches
+// m's gradients. Optimizer state and history are not copied.
+//
+// Callers must hold m.mu.
+func (m *Model) cloneParams() *Model {
+	clones := make(map[*Value]*Value, len(m.Params))
+	c := &Model{
+		Config:    m.Config,
+		VocabSize: m.VocabSize,
+		Chars:     m.Chars,
+		BOS:       m.BOS,
+		Params:    make([]*Value, len(m.Params)),
+		decay:     m.decay,
+		State:     make(map[string][][]*Value, len(m.State)),
+	}
+	for i, p := range m.Params {
+		c.Params[i] = NewValue(p.Data)
+		clones[p] = c.Params[i]
+	}
+	// A tied lm_head maps onto the same cloned rows as wte.
+	for name, mat := range m.State {
+		rows := make([][]*Value, len(mat))
+		for i, row := range mat {
+			rows[i] = make([]*Value, len(row))
+			for j, v := range row {
+				rows[i][j] = clones[v]
+			}
+		}
+		c.State[name] = rows
+	}
+	return c
+}
+
 // Linear computes y = W*x where:
 // - x is a vector
 // - W is matrix with shape [out_dim][in_dim]
@@ -170,14 +354,34 @@ func (m *Model) RMSNorm(x []*Value) []*Value {
 	return out
 }
 
+// Adam hyperparameters shared by Update and the weight inspector.
+const (
+	adamBeta1 = 0.85
+	adamBeta2 = 0.99
+	adamEps   = 1e-8
+)
+
 // Update performs one Adam optimization step over all parameters.
+//
+// Regularization (weight matrices only, never norm gains/biases):
+// - l2 adds l2 * w to the gradient, so Adam sees a pull toward zero.
+// - weight_decay shrinks w directly by lr * weight_decay * w (decoupled, AdamW style).
 func (m *Model) Update() {
 	m.Steps++
+	m.frozen = nil
 
 	lr := m.Config.LearningRate
-	beta1, beta2, eps := 0.85, 0.99, 1e-8
+	beta1, beta2, eps := adamBeta1, adamBeta2, adamEps
 
 	for i, p := range m.Params {
+		if m.decay[i] {
+			if m.Config.L2 > 0 {
+				p.Grad += m.Config.L2 * p.Data
+			}
+			if m.Config.WeightDecay > 0 {
+				p.Data -= lr * m.Config.WeightDecay * p.Data
+			}
+		}
 		m.AdamM[i] = beta1*m.AdamM[i] + (1-beta1)*p.Grad
 		m.AdamV[i] = beta2*m.AdamV[i] + (1-beta2)*p.Grad*p.Grad
 
@@ -186,6 +390,7 @@ func (m *Model) Update() {
 		vHat := m.AdamV[i] / (1 - math.Pow(beta2, float64(m.Steps)))
 
 		p.Data -= lr * mHat / (math.Sqrt(vHat) + eps)
+		m.lastGrad[i] = p.Grad
 		p.Grad = 0
 	}
 }
@@ -0,0 +1,137 @@
+package main
+
+import "math"
+
+// Normalization options selectable with Config.Norm and Config.NormPlacement.
+//
+// Norm:
+// - rmsnorm: divide by the root-mean-square so the vector has "size 1".
+// - layernorm: subtract the mean first, then divide by the standard deviation.
+// - none: no normalization at all (try it to see why training gets unstable).
+//
+// Both real norms are followed by a learnable per-feature gain (start 1),
+// and LayerNorm also has a learnable bias (start 0), so the model can undo
+// the normalization where it hurts.
+//
+// Placement:
+// - pre: normalize the input of each attention/MLP block (GPT-2 style).
+// - post: normalize after adding the residual (original Transformer style).
+const (
+	NormRMS   = "rmsnorm"
+	NormLayer = "layernorm"
+	NormNone  = "none"
+
+	NormPre  = "pre"
+	NormPost = "post"
+)
+
+// norm returns the configured normalization, defaulting to rmsnorm.
+func (c Config) norm() string {
+	if c.Norm == "" {
+		return NormRMS
+	}
+	return c.Norm
+}
+
+// normPlacement returns the configured placement, defaulting to pre.
+func (c Config) normPlacement() string {
+	if c.NormPlacement == "" {
+		return NormPre
+	}
+	return c.NormPlacement
+}
+
+// LayerNorm centers x on its mean and scales it to unit variance.
+func (m *Model) LayerNorm(x []*Value) []*Value {
+	sum := NewValue(0)
+	for _, xi := range x {
+		sum = sum.Add(xi)
+	}
+	negMean := sum.Mul(NewValue(-1.0 / float64(len(x))))
+
+	centered := make([]*Value, len(x))
+	sumSq := NewValue(0)
+	for i, xi := range x {
+		centered[i] = xi.Add(negMean)
+		sumSq = sumSq.Add(centered[i].Mul(centered[i]))
+	}
+	variance := sumSq.Mul(NewValue(1.0 / float64(len(x))))
+	scale := variance.Add(NewValue(1e-5)).Pow(-0.5)
+
+	out := make([]*Value, len(x))
+	for i, ci := range centered {
+		out[i] = ci.Mul(scale)
+	}
+	return out
+}
+
+// normalize applies the configured norm plus its learnable gain/bias at one
+// named site (for example "layer0.attn_norm").
+func (m *Model) normalize(x []*Value, site string) []*Value {
+	switch m.Config.norm() {
+	case NormNone:
+		return x
+	case NormLayer:
+		x = m.LayerNorm(x)
+	default:
+		x = m.RMSNorm(x)
+	}
+
+	gain := m.State[site+".gain"][0]
+	bias, hasBias := m.State[site+".bias"]
+	out := make([]*Value, len(x))
+	for i := range x {
+		out[i] = x[i].Mul(gain[i])
+		if hasBias {
+			out[i] = out[i].Add(bias[0][i])
+		}
+	}
+	return out
+}
+
+// layerNormData is the float64 twin of Model.LayerNorm.
+func layerNormData(x []float64) []float64 {
+	sum := 0.0
+	for _, xi := range x {
+		sum += xi
+	}
+	negMean := float64(sum * (-1.0 / float64(len(x))))
+
+	centered := make([]float64, len(x))
+	sumSq := 0.0
+	for i, xi := range x {
+		centered[i] = xi + negMean
+		sumSq += float64(centered[i] * centered[i])
+	}
+	variance := float64(sumSq * (1.0 / float64(len(x))))
+	scale := math.Pow(variance+1e-5, -0.5)
+
+	out := make([]float64, len(x))
+	for i, ci := range centered {
+		out[i] = ci * scale
+	}
+	return out
+}
+
+// normalize is the float64 twin of Model.normalize.
+func (im *InferenceModel) normalize(x []float64, site string) []float64 {
+	switch im.Config.norm() {
+	case NormNone:
+		return x
+	case NormLayer:
+		x = layerNormData(x)
+	default:
+		x = rmsNormData(x)
+	}
+
+	gain := im.Weights[site+".gain"][0]
+	bias, hasBias := im.Weights[site+".bias"]
+	out := make([]float64, len(x))
+	for i := range x {
+		out[i] = float64(x[i] * gain[i])
+		if hasBias {
+			out[i] += bias[0][i]
+		}
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package main
+
+import "fmt"
+
+// patchSites lists the sites swept by /api/inspect/patch, one grid row each.
+func patchSites(c Config, kind string) ([]hookSite, error) {
+	switch kind {
+	case "", "residual":
+		return lensDepths(c), nil
+	case "head":
+		sites := []hookSite{}
+		for li := 0; li < c.NLayer; li++ {
+			for h := 0; h < c.NHead; h++ {
+				sites = append(sites, hookSite{Name: "head", Layer: li, Head: h})
+			}
+		}
+		return sites, nil
+	}
+	return nil, fmt.Errorf("unknown patch site %q (use residual or head)", kind)
+}
+
+// tokenByLabel finds a token ID from its display label (a character or "<END>").
+func tokenByLabel(im *InferenceModel, label string) (int, error) {
+	if label == tokenLabel(im.BOS, im.BOS, im.Chars) {
+		return im.BOS, nil
+	}
+	for i, c := range im.Chars {
+		if c == label {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("target %q is not in the model vocabulary", label)
+}
+
+// patchGrid sweeps sites x positions. Each cell re-runs the corrupted tokens
+// with one clean vector pasted in and reads the target probability at the
+// last position; where the clean answer comes back, that site and position
+// carried the information the corruption changed.
+func patchGrid(im *InferenceModel, clean []*forwardHooks, corrupted []int, sites []hookSite, target int, cleanProb, corruptedProb float64) ([]PatchRow, error) {
+	last := len(corrupted) - 2
+	rows := make([]PatchRow, len(sites))
+	for r, site := range sites {
+		row := PatchRow{Site: site.String(), Prob: make([]float64, len(clean)), Restored: make([]float64, len(clean))}
+		for pos := range clean {
+			patch := &forwardHooks{edits: map[hookSite]siteEdit{site: {values: clean[pos].vectors[site]}}}
+			logits, err := runSequence(im, corrupted, func(p int) *forwardHooks {
+				if p == pos {
+					return patch
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			prob := softmaxData(logits[last])[target]
+			row.Prob[pos] = prob
+			if gap := cleanProb - corruptedProb; gap != 0 {
+				row.Restored[pos] = (prob - corruptedProb) / gap
+			}
+		}
+		rows[r] = row
+	}
+	return rows, nil
+}
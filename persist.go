@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFileVersion is bumped whenever the on-disk layout changes incompatibly.
+//
+// Version 2 added learnable norm gains to Params.
+const stateFileVersion = 2
+
+// savedState is everything the server needs to come back after a restart.
+type savedState struct {
+	Version int         `json:"version"`
+	SavedAt time.Time   `json:"saved_at"`
+	Docs    []string    `json:"docs"`
+	ValDocs []string    `json:"validation_docs,omitempty"`
+	Model   *savedModel `json:"model,omitempty"`
+	Draft   *savedModel `json:"draft,omitempty"`
+}
+
+// savedModel is the serializable form of a Model.
+//
+// Params, AdamM and AdamV are flat lists in Model.Params order.
+// That order is fully determined by Config + Chars, so rebuilding the model
+// with newModelWithVocab and copying the numbers back restores it exactly.
+type savedModel struct {
+	Config Config    `json:"config"`
+	Chars  []string  `json:"chars"`
+	Steps  int       `json:"steps"`
+	Params []float64 `json:"params"`
+	AdamM  []float64 `json:"adam_m"`
+	AdamV  []float64 `json:"adam_v"`
+
+	History []StepRecord `json:"history,omitempty"`
+}
+
+// saveModel copies parameter and optimizer state out of a model.
+//
+// Callers must hold model.mu.
+func saveModel(m *Model) *savedModel {
+	params := make([]float64, len(m.Params))
+	for i, p := range m.Params {
+		params[i] = p.Data
+	}
+	return &savedModel{
+		Config: m.Config,
+		Chars:  append([]string(nil), m.Chars...),
+		Steps:  m.Steps,
+		Params: params,
+		AdamM:  append([]float64(nil), m.AdamM...),
+		AdamV:  append([]float64(nil), m.AdamV...),
+
+		History: append([]StepRecord(nil), m.History...),
+	}
+}
+
+// restoreModel rebuilds a Model from its saved form.
+func restoreModel(sm *savedModel) (*Model, error) {
+	if err := sm.Config.Validate(); err != nil {
+		return nil, err
+	}
+	m := newModelWithVocab(sm.Config, sm.Chars)
+	if len(sm.Params) != len(m.Params) || len(sm.AdamM) != len(m.Params) || len(sm.AdamV) != len(m.Params) {
+		return nil, fmt.Errorf("saved model has %d params, config expects %d", len(sm.Params), len(m.Params))
+	}
+	for i, p := range m.Params {
+		p.Data = sm.Params[i]
+	}
+	copy(m.AdamM, sm.AdamM)
+	copy(m.AdamV, sm.AdamV)
+	m.Steps = sm.Steps
+	m.History = sm.History
+	return m, nil
+}
+
+// Store persists server state inside one data directory.
+//
+// Safety rules:
+// - An exclusive lock file keeps two server processes from sharing a directory.
+// - Writes go to a temp file that is fsynced, then renamed over the old file.
+// - So a crash mid-write always leaves the previous state intact.
+type Store struct {
+	dir  string
+	lock *os.File
+}
+
+// OpenStore creates dir if needed and takes the directory lock.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, "state.lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+	if err := lockFile(lock); err != nil {
+		_ = lock.Close()
+		return nil, fmt.Errorf("data dir %s is in use by another process: %w", dir, err)
+	}
+	return &Store{dir: dir, lock: lock}, nil
+}
+
+// Close releases the directory lock.
+func (st *Store) Close() error {
+	_ = unlockFile(st.lock)
+	return st.lock.Close()
+}
+
+func (st *Store) statePath() string {
+	return filepath.Join(st.dir, "state.json")
+}
+
+// Load reads the last saved state. It returns nil, nil when nothing was saved yet.
+func (st *Store) Load() (*savedState, error) {
+	data, err := os.ReadFile(st.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", st.statePath(), err)
+	}
+	if state.Version != stateFileVersion {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	return &state, nil
+}
+
+// SetAside renames an unreadable state.json to state.json.bad-<timestamp>,
+// so the next save cannot overwrite the only copy. It returns the new path.
+func (st *Store) SetAside() (string, error) {
+	bad := fmt.Sprintf("%s.bad-%s", st.statePath(), time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Rename(st.statePath(), bad); err != nil {
+		return "", err
+	}
+	return bad, nil
+}
+
+// Save writes state atomically: temp file, fsync, rename, fsync directory.
+func (st *Store) Save(state *savedState) error {
+	state.Version = stateFileVersion
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(st.dir, "state-*.json.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, st.statePath()); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable.
+	if dir, err := os.Open(st.dir); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// SetStore enables persistence. Call before serving requests.
+func (s *Server) SetStore(st *Store) {
+	s.store = st
+}
+
+// RestoreState loads the last saved model/docs into the server, if any.
+func (s *Server) RestoreState() error {
+	if s.store == nil {
+		return nil
+	}
+	state, err := s.store.Load()
+	if err != nil || state == nil {
+		return err
+	}
+	var model *Model
+	if state.Model != nil {
+		if model, err = restoreModel(state.Model); err != nil {
+			return err
+		}
+	}
+	var draft *Model
+	if state.Draft != nil {
+		if draft, err = restoreModel(state.Draft); err != nil {
+			return fmt.Errorf("draft model: %w", err)
+		}
+		if model == nil || !sameVocab(draft, model) {
+			return errors.New("saved draft model does not match the main model's vocabulary")
+		}
+	}
+	s.setModel(model, state.Docs, state.ValDocs)
+	s.setDraft(draft)
+
+	s.saveMu.Lock()
+	s.lastSavedModel, s.lastSavedSteps = model, state.Model.stepsOrZero()
+	s.lastSavedDraft, s.lastSavedDraftSteps = draft, state.Draft.stepsOrZero()
+	s.saveMu.Unlock()
+	return nil
+}
+
+func (sm *savedModel) stepsOrZero() int {
+	if sm == nil {
+		return 0
+	}
+	return sm.Steps
+}
+
+// SaveState writes the active model/docs and the draft model to the store.
+//
+// Unless force is set, it skips the write when nothing changed since the
+// last save (same models, same optimizer step counts).
+func (s *Server) SaveState(force bool) error {
+	if s.store == nil {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	model, docs := s.snapshot()
+	draft := s.draftModel()
+	if !force && model == s.lastSavedModel && modelSteps(model) == s.lastSavedSteps &&
+		draft == s.lastSavedDraft && modelSteps(draft) == s.lastSavedDraftSteps {
+		return nil
+	}
+	state := &savedState{
+		SavedAt: time.Now().UTC(),
+		Docs:    docs,
+		ValDocs: s.validationDocs(),
+		Model:   lockAndSaveModel(model),
+		Draft:   lockAndSaveModel(draft),
+	}
+	if err := s.store.Save(state); err != nil {
+		return err
+	}
+	s.lastSavedModel, s.lastSavedSteps = model, state.Model.stepsOrZero()
+	s.lastSavedDraft, s.lastSavedDraftSteps = draft, state.Draft.stepsOrZero()
+	return nil
+}
+
+// modelSteps reads m.Steps under its lock (0 for nil).
+func modelSteps(m *Model) int {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Steps
+}
+
+// lockAndSaveModel is saveModel under m's lock (nil for nil).
+func lockAndSaveModel(m *Model) *savedModel {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return saveModel(m)
+}
+
+// RunAutosave saves state every interval until done is closed.
+func (s *Server) RunAutosave(done <-chan struct{}, interval time.Duration) {
+	if s.store == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := s.SaveState(false); err != nil {
+				log.Printf("autosave failed: %v", err)
+			}
+		}
+	}
+}
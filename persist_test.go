@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func TestStoreIgnoresLeftoverTempFile(t *testing.T) {
+	dir := t.TempDir()
+	st := openTestStore(t, dir)
+	if err := st.Save(&savedState{Docs: []string{"anna"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash between CreateTemp and Rename leaves a half-written temp file.
+	leftover := filepath.Join(dir, "state-123.json.tmp")
+	if err := os.WriteFile(leftover, []byte(`{"version":2,"docs":["tor`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Docs) != 1 || state.Docs[0] != "anna" {
+		t.Fatalf("loaded docs %v, want [anna]", state.Docs)
+	}
+
+	if err := st.Save(&savedState{Docs: []string{"bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = st.Load(); err != nil || state.Docs[0] != "bob" {
+		t.Fatalf("after a new save: %v, %v", state, err)
+	}
+	if _, err := os.Stat(leftover); err != nil {
+		t.Fatalf("Save should leave other temp files alone: %v", err)
+	}
+}
+
+func TestStoreSetsAsideUnreadableState(t *testing.T) {
+	dir := t.TempDir()
+	st := openTestStore(t, dir)
+	bad := []byte(`{"version":2,"model":`)
+	if err := os.WriteFile(st.statePath(), bad, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer()
+	s.SetStore(st)
+	if err := s.RestoreState(); err == nil {
+		t.Fatal("expected RestoreState to fail on a truncated state file")
+	}
+	moved, err := st.SetAside()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(moved); err != nil || string(data) != string(bad) {
+		t.Fatalf("set-aside file %s: %q, %v", moved, data, err)
+	}
+
+	// The fresh server's first save must not touch the set-aside copy.
+	if err := s.SaveState(true); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(moved); err != nil || string(data) != string(bad) {
+		t.Fatalf("set-aside file changed after a save: %q, %v", data, err)
+	}
+	if state, err := st.Load(); err != nil || state == nil {
+		t.Fatalf("new state file: %v, %v", state, err)
+	}
+}
+
+func TestStoreRestoresModelAndDraft(t *testing.T) {
+	st := openTestStore(t, t.TempDir())
+	s := NewServer()
+	s.SetStore(st)
+	model := newTestModel(t, Config{})
+	draft := newTestModel(t, Config{NEmpd: 8, NHead: 2, NLayer: 1, BlockSize: 8})
+	model.Steps = 3
+	s.setModel(model, testDocs, nil)
+	s.setDraft(draft)
+	if err := s.SaveState(false); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewServer()
+	restored.SetStore(st)
+	if err := restored.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	got, docs := restored.snapshot()
+	gotDraft := restored.draftModel()
+	if got == nil || gotDraft == nil || len(docs) != len(testDocs) || got.Steps != 3 {
+		t.Fatalf("restored model %v, draft %v, docs %v", got, gotDraft, docs)
+	}
+	for _, pair := range [][2]*Model{{model, got}, {draft, gotDraft}} {
+		for i, p := range pair[0].Params {
+			if pair[1].Params[i].Data != p.Data {
+				t.Fatalf("param %d: restored %v, saved %v", i, pair[1].Params[i].Data, p.Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "math"
+
+// Position encoding schemes selectable with Config.PositionEncoding:
+// - learned: a trainable vector per position (wpe), added to the token vector.
+// - sinusoidal: a fixed sine/cosine pattern per position, added to the token vector.
+// - rope: rotate query/key pairs by a position-dependent angle (q·k sees relative distance).
+// - alibi: no position vectors; attention scores get a per-head penalty that grows with distance.
+//
+// Only learned needs a table sized block_size, so the other three can
+// generate sequences longer than anything seen in training.
+const (
+	PositionLearned    = "learned"
+	PositionSinusoidal = "sinusoidal"
+	PositionRoPE       = "rope"
+	PositionALiBi      = "alibi"
+)
+
+// maxGenerateLen caps generation for encodings that can run past block_size.
+const maxGenerateLen = 256
+
+// positionEncoding returns the configured scheme, defaulting to learned.
+func (c Config) positionEncoding() string {
+	if c.PositionEncoding == "" {
+		return PositionLearned
+	}
+	return c.PositionEncoding
+}
+
+// generationLimit returns how many positions one generation may use.
+//
+// maxLen <= 0 keeps the classic limit of block_size. Larger values are
+// honoured only by encodings that can extrapolate past block_size.
+func generationLimit(c Config, maxLen int) int {
+	if maxLen <= 0 {
+		return c.BlockSize
+	}
+	if c.positionEncoding() == PositionLearned && maxLen > c.BlockSize {
+		return c.BlockSize
+	}
+	if maxLen > maxGenerateLen {
+		return maxGenerateLen
+	}
+	return maxLen
+}
+
+// sinusoidalEncoding is the fixed "Attention Is All You Need" position vector:
+// PE[pos][2i] = sin(pos / 10000^(2i/d)), PE[pos][2i+1] = cos(same angle).
+func sinusoidalEncoding(pos, dim int) []float64 {
+	pe := make([]float64, dim)
+	for i := 0; i < dim; i++ {
+		angle := float64(pos) / math.Pow(10000, float64(i-i%2)/float64(dim))
+		if i%2 == 0 {
+			pe[i] = math.Sin(angle)
+		} else {
+			pe[i] = math.Cos(angle)
+		}
+	}
+	return pe
+}
+
+// ropeAngle is the rotation angle for dimension pair `pair` of a head at `pos`.
+func ropeAngle(pos, pair, headDim int) float64 {
+	return float64(pos) / math.Pow(10000, float64(2*pair)/float64(headDim))
+}
+
+// alibiSlope is head h's distance penalty slope: 2^(-8(h+1)/n_head).
+func alibiSlope(h, nHead int) float64 {
+	return math.Pow(2, -8*float64(h+1)/float64(nHead))
+}
+
+// ropeValues rotates each head's (even, odd) dimension pairs in a graph vector.
+func ropeValues(vec []*Value, headDim, pos int) []*Value {
+	out := make([]*Value, len(vec))
+	for hs := 0; hs < len(vec); hs += headDim {
+		for p := 0; p < headDim/2; p++ {
+			a, b := vec[hs+2*p], vec[hs+2*p+1]
+			angle := ropeAngle(pos, p, headDim)
+			c, s := math.Cos(angle), math.Sin(angle)
+			out[hs+2*p] = a.Mul(NewValue(c)).Add(b.Mul(NewValue(-s)))
+			out[hs+2*p+1] = a.Mul(NewValue(s)).Add(b.Mul(NewValue(c)))
+		}
+	}
+	return out
+}
+
+// ropeData is the float64 twin of ropeValues.
+func ropeData(vec []float64, headDim, pos int) []float64 {
+	out := make([]float64, len(vec))
+	for hs := 0; hs < len(vec); hs += headDim {
+		for p := 0; p < headDim/2; p++ {
+			a, b := vec[hs+2*p], vec[hs+2*p+1]
+			angle := ropeAngle(pos, p, headDim)
+			c, s := math.Cos(angle), math.Sin(angle)
+			out[hs+2*p] = float64(a*c) + float64(b*-s)
+			out[hs+2*p+1] = float64(a*s) + float64(b*c)
+		}
+	}
+	return out
+}
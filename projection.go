@@ -0,0 +1,332 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// This file holds small, dependency-free helpers that turn high-dimensional
+// embedding vectors into something a student can look at: 2-D maps (PCA,
+// t-SNE) and "which vectors are most similar" lists.
+
+// pca2 projects vectors onto their top two principal components.
+//
+// Steps:
+// 1) Center the data (subtract the mean vector).
+// 2) Build covariance matrix C = X^T X / n.
+// 3) Find the top eigenvector of C by power iteration: repeatedly v = C v, normalize.
+// 4) Remove that direction from C (deflation) and repeat for the second one.
+//
+// It returns the 2-D coordinates and the fraction of total variance that
+// each of the two components explains.
+func pca2(vectors [][]float64) ([][2]float64, [2]float64) {
+	n := len(vectors)
+	coords := make([][2]float64, n)
+	var explained [2]float64
+	if n == 0 || len(vectors[0]) == 0 {
+		return coords, explained
+	}
+	dim := len(vectors[0])
+
+	mean := make([]float64, dim)
+	for _, v := range vectors {
+		for j, x := range v {
+			mean[j] += x / float64(n)
+		}
+	}
+	centered := make([][]float64, n)
+	for i, v := range vectors {
+		centered[i] = make([]float64, dim)
+		for j, x := range v {
+			centered[i][j] = x - mean[j]
+		}
+	}
+
+	cov := make([][]float64, dim)
+	for a := range cov {
+		cov[a] = make([]float64, dim)
+	}
+	for _, v := range centered {
+		for a := 0; a < dim; a++ {
+			for b := 0; b < dim; b++ {
+				cov[a][b] += v[a] * v[b] / float64(n)
+			}
+		}
+	}
+	trace := 0.0
+	for a := 0; a < dim; a++ {
+		trace += cov[a][a]
+	}
+
+	for c := 0; c < 2 && c < dim; c++ {
+		vec, eigenvalue := powerIteration(cov)
+		if trace > 0 {
+			explained[c] = eigenvalue / trace
+		}
+		for i, v := range centered {
+			dot := 0.0
+			for j := range v {
+				dot += v[j] * vec[j]
+			}
+			coords[i][c] = dot
+		}
+		// Deflate: C <- C - lambda * v v^T.
+		for a := 0; a < dim; a++ {
+			for b := 0; b < dim; b++ {
+				cov[a][b] -= eigenvalue * vec[a] * vec[b]
+			}
+		}
+	}
+	return coords, explained
+}
+
+// powerIteration returns the dominant eigenvector/eigenvalue of a symmetric matrix.
+//
+// The start vector and sign convention are fixed so repeated calls during
+// training give stable (non-flipping) plots.
+func powerIteration(mat [][]float64) ([]float64, float64) {
+	dim := len(mat)
+	vec := make([]float64, dim)
+	for i := range vec {
+		vec[i] = 1 + float64(i)/float64(dim)
+	}
+	normalize(vec)
+
+	eigenvalue := 0.0
+	for iter := 0; iter < 500; iter++ {
+		next := make([]float64, dim)
+		for a := 0; a < dim; a++ {
+			for b := 0; b < dim; b++ {
+				next[a] += mat[a][b] * vec[b]
+			}
+		}
+		norm := normalize(next)
+		if norm == 0 {
+			break
+		}
+		delta := 0.0
+		for i := range vec {
+			delta += math.Abs(next[i] - vec[i])
+		}
+		vec, eigenvalue = next, norm
+		if delta < 1e-10 {
+			break
+		}
+	}
+
+	// Make the largest-magnitude entry positive.
+	maxIdx := 0
+	for i := range vec {
+		if math.Abs(vec[i]) > math.Abs(vec[maxIdx]) {
+			maxIdx = i
+		}
+	}
+	if vec[maxIdx] < 0 {
+		for i := range vec {
+			vec[i] = -vec[i]
+		}
+	}
+	return vec, eigenvalue
+}
+
+// normalize scales v to unit length in place and returns its original length.
+func normalize(v []float64) float64 {
+	sumSq := 0.0
+	for _, x := range v {
+		sumSq += x * x
+	}
+	norm := math.Sqrt(sumSq)
+	if norm > 0 {
+		for i := range v {
+			v[i] /= norm
+		}
+	}
+	return norm
+}
+
+// cosineSimilarity measures the angle between two vectors (1 = same direction).
+func cosineSimilarity(a, b []float64) float64 {
+	dot, na, nb := 0.0, 0.0, 0.0
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// nearestNeighbors returns, for each vector, the indices of the k most
+// cosine-similar other vectors together with their similarities.
+func nearestNeighbors(vectors [][]float64, k int) ([][]int, [][]float64) {
+	idx := make([][]int, len(vectors))
+	sims := make([][]float64, len(vectors))
+	for i := range vectors {
+		others := make([]int, 0, len(vectors)-1)
+		sim := make([]float64, len(vectors))
+		for j := range vectors {
+			if j != i {
+				others = append(others, j)
+				sim[j] = cosineSimilarity(vectors[i], vectors[j])
+			}
+		}
+		sort.SliceStable(others, func(a, b int) bool {
+			return sim[others[a]] > sim[others[b]]
+		})
+		if len(others) > k {
+			others = others[:k]
+		}
+		idx[i] = others
+		sims[i] = make([]float64, len(others))
+		for n, j := range others {
+			sims[i][n] = sim[j]
+		}
+	}
+	return idx, sims
+}
+
+// tsne2 computes a 2-D t-SNE map (exact O(n^2) version, fine for tiny vocabularies).
+//
+// How it works:
+// - In the original space, turn distances into "neighbor probabilities" P.
+// - In 2-D, do the same with a heavy-tailed Student-t curve to get Q.
+// - Move 2-D points by gradient descent until Q looks like P.
+//
+// Points start from the PCA layout, so the result is deterministic.
+func tsne2(vectors [][]float64, perplexity float64, iterations int) [][2]float64 {
+	n := len(vectors)
+	y := make([][2]float64, n)
+	if n < 3 {
+		return y
+	}
+	if maxPerp := float64(n-1) / 3; perplexity > maxPerp {
+		perplexity = maxPerp
+	}
+	if perplexity < 1 {
+		perplexity = 1
+	}
+
+	// Squared distances in the original space.
+	dist := make([][]float64, n)
+	for i := range dist {
+		dist[i] = make([]float64, n)
+		for j := range dist[i] {
+			d := 0.0
+			for k := range vectors[i] {
+				diff := vectors[i][k] - vectors[j][k]
+				d += diff * diff
+			}
+			dist[i][j] = d
+		}
+	}
+
+	// Conditional probabilities with a per-point bandwidth found by binary search
+	// so each row's entropy matches log(perplexity).
+	p := make([][]float64, n)
+	targetEntropy := math.Log(perplexity)
+	for i := 0; i < n; i++ {
+		p[i] = make([]float64, n)
+		beta, lo, hi := 1.0, 0.0, math.Inf(1)
+		for iter := 0; iter < 64; iter++ {
+			sum := 0.0
+			for j := 0; j < n; j++ {
+				if j != i {
+					p[i][j] = math.Exp(-dist[i][j] * beta)
+					sum += p[i][j]
+				}
+			}
+			if sum == 0 {
+				sum = 1e-12
+			}
+			entropy := 0.0
+			for j := 0; j < n; j++ {
+				if j != i {
+					p[i][j] /= sum
+					if p[i][j] > 0 {
+						entropy -= p[i][j] * math.Log(p[i][j])
+					}
+				}
+			}
+			if math.Abs(entropy-targetEntropy) < 1e-5 {
+				break
+			}
+			if entropy > targetEntropy {
+				lo = beta
+				if math.IsInf(hi, 1) {
+					beta *= 2
+				} else {
+					beta = (beta + hi) / 2
+				}
+			} else {
+				hi = beta
+				beta = (beta + lo) / 2
+			}
+		}
+	}
+	// Symmetrize: P_ij = (p_j|i + p_i|j) / 2n.
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			v := math.Max((p[i][j]+p[j][i])/float64(2*n), 1e-12)
+			p[i][j], p[j][i] = v, v
+		}
+	}
+
+	// Start from a small-scale PCA layout.
+	init, _ := pca2(vectors)
+	scale := 0.0
+	for _, c := range init {
+		scale = math.Max(scale, math.Max(math.Abs(c[0]), math.Abs(c[1])))
+	}
+	for i := range y {
+		if scale > 0 {
+			y[i] = [2]float64{init[i][0] / scale * 1e-2, init[i][1] / scale * 1e-2}
+		} else {
+			y[i] = [2]float64{float64(i) * 1e-4, float64(i%2) * 1e-4}
+		}
+	}
+
+	velocity := make([][2]float64, n)
+	num := make([][]float64, n)
+	for i := range num {
+		num[i] = make([]float64, n)
+	}
+	const learningRate = 50.0
+	for iter := 0; iter < iterations; iter++ {
+		exaggeration, momentum := 1.0, 0.8
+		if iter < 100 {
+			exaggeration, momentum = 4.0, 0.5
+		}
+
+		sumNum := 0.0
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				dx, dy := y[i][0]-y[j][0], y[i][1]-y[j][1]
+				v := 1 / (1 + dx*dx + dy*dy)
+				num[i][j], num[j][i] = v, v
+				sumNum += 2 * v
+			}
+		}
+		for i := 0; i < n; i++ {
+			var grad [2]float64
+			for j := 0; j < n; j++ {
+				if j == i {
+					continue
+				}
+				q := math.Max(num[i][j]/sumNum, 1e-12)
+				mult := 4 * (exaggeration*p[i][j] - q) * num[i][j]
+				grad[0] += mult * (y[i][0] - y[j][0])
+				grad[1] += mult * (y[i][1] - y[j][1])
+			}
+			for d := 0; d < 2; d++ {
+				velocity[i][d] = momentum*velocity[i][d] - learningRate*grad[d]
+			}
+		}
+		for i := range y {
+			y[i][0] += velocity[i][0]
+			y[i][1] += velocity[i][1]
+		}
+	}
+	return y
+}
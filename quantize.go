@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// QuantizationScheme names what /api/inspect/quantization rounds: only the
+// stored weights. A frozen model's weights are turned back into float64
+// (dequantized) to run it, so activations and matrix products stay float64
+// and the saving is memory, not arithmetic.
+const QuantizationScheme = "weight-only"
+
+// Precisions accepted by GenerateOptions.Precision and /api/inspect/quantization.
+// float32 keeps about 7 significant digits (float64 about 16) in half the
+// memory; int8 stores each weight as a whole number from -127 to 127 plus one
+// scale per matrix row (weight ≈ q * scale), 8x smaller than float64.
+const (
+	PrecisionFloat64 = "float64"
+	PrecisionFloat32 = "float32"
+	PrecisionInt8    = "int8"
+)
+
+// defaultQuantizationDocs is how many training docs
+// /api/inspect/quantization scores when max_docs is not set.
+const defaultQuantizationDocs = 200
+
+// FrozenModel is a read-only export of an InferenceModel at one precision.
+type FrozenModel struct {
+	Precision string
+	base      *InferenceModel
+	matrices  map[string]frozenMatrix
+}
+
+// frozenMatrix holds one weight matrix in exactly one of the stored forms.
+type frozenMatrix struct {
+	f64    [][]float64
+	f32    [][]float32
+	i8     [][]int8
+	scales []float32 // int8 only: one scale per row
+}
+
+func checkPrecision(precision string) error {
+	switch precision {
+	case "", PrecisionFloat64, PrecisionFloat32, PrecisionInt8:
+		return nil
+	}
+	return fmt.Errorf("unknown precision %q (use float64, float32 or int8)", precision)
+}
+
+// Freeze exports im's weights at precision ("" means float64).
+func (im *InferenceModel) Freeze(precision string) (*FrozenModel, error) {
+	if err := checkPrecision(precision); err != nil {
+		return nil, err
+	}
+	if precision == "" {
+		precision = PrecisionFloat64
+	}
+	f := &FrozenModel{Precision: precision, base: im, matrices: make(map[string]frozenMatrix, len(im.Weights))}
+	for name, rows := range im.Weights {
+		var fm frozenMatrix
+		switch precision {
+		case PrecisionFloat64:
+			fm.f64 = rows
+		case PrecisionFloat32:
+			fm.f32 = make([][]float32, len(rows))
+			for i, row := range rows {
+				fm.f32[i] = make([]float32, len(row))
+				for j, w := range row {
+					fm.f32[i][j] = float32(w)
+				}
+			}
+		case PrecisionInt8:
+			fm.i8 = make([][]int8, len(rows))
+			fm.scales = make([]float32, len(rows))
+			for i, row := range rows {
+				fm.i8[i], fm.scales[i] = quantizeRow(row)
+			}
+		}
+		f.matrices[name] = fm
+	}
+	return f, nil
+}
+
+// quantizeRow maps row onto -127..127 with a symmetric per-row scale, so the
+// largest weight (in absolute value) keeps full resolution.
+func quantizeRow(row []float64) ([]int8, float32) {
+	maxAbs := 0.0
+	for _, w := range row {
+		maxAbs = math.Max(maxAbs, math.Abs(w))
+	}
+	q := make([]int8, len(row))
+	if maxAbs == 0 {
+		return q, 0
+	}
+	scale := float32(maxAbs / 127)
+	for j, w := range row {
+		q[j] = int8(math.Max(-127, math.Min(127, math.Round(w/float64(scale)))))
+	}
+	return q, scale
+}
+
+// Bytes is the memory the stored weights take. A tied lm_head is the same
+// matrix as wte, so it is counted once.
+func (f *FrozenModel) Bytes() int {
+	total := 0
+	for name, fm := range f.matrices {
+		if name == "lm_head" && f.base.Config.TieEmbeddings {
+			continue
+		}
+		switch f.Precision {
+		case PrecisionFloat64:
+			total += 8 * countNumbers(fm.f64)
+		case PrecisionFloat32:
+			for _, row := range fm.f32 {
+				total += 4 * len(row)
+			}
+		case PrecisionInt8:
+			for _, row := range fm.i8 {
+				total += len(row)
+			}
+			total += 4 * len(fm.scales)
+		}
+	}
+	return total
+}
+
+func countNumbers(rows [][]float64) int {
+	n := 0
+	for _, row := range rows {
+		n += len(row)
+	}
+	return n
+}
+
+// Inference dequantizes the frozen weights into a runnable InferenceModel.
+func (f *FrozenModel) Inference() *InferenceModel {
+	weights := make(map[string][][]float64, len(f.matrices))
+	for name, fm := range f.matrices {
+		switch f.Precision {
+		case PrecisionFloat64:
+			weights[name] = fm.f64
+		case PrecisionFloat32:
+			rows := make([][]float64, len(fm.f32))
+			for i, row := range fm.f32 {
+				rows[i] = make([]float64, len(row))
+				for j, w := range row {
+					rows[i][j] = float64(w)
+				}
+			}
+			weights[name] = rows
+		case PrecisionInt8:
+			rows := make([][]float64, len(fm.i8))
+			for i, row := range fm.i8 {
+				rows[i] = make([]float64, len(row))
+				for j, q := range row {
+					rows[i][j] = float64(q) * float64(fm.scales[i])
+				}
+			}
+			weights[name] = rows
+		}
+	}
+	im := *f.base
+	im.Weights = weights
+	return &im
+}
+
+// atPrecision returns im itself for float64 (or ""), otherwise a frozen,
+// dequantized copy. Callers validate precision first (see checkPrecision).
+func (im *InferenceModel) atPrecision(precision string) *InferenceModel {
+	if precision == "" || precision == PrecisionFloat64 {
+		return im
+	}
+	f, err := im.Freeze(precision)
+	if err != nil {
+		return im
+	}
+	return f.Inference()
+}
+
+// inferenceAt is m.Inference().atPrecision(precision), except that frozen
+// copies are kept per precision until the next Update changes the weights,
+// so repeated generation does not quantize them again.
+//
+// Callers must hold m.mu.
+func (m *Model) inferenceAt(precision string) *InferenceModel {
+	if precision == "" || precision == PrecisionFloat64 {
+		return m.Inference()
+	}
+	if im, ok := m.frozen[precision]; ok {
+		return im
+	}
+	im := m.Inference().atPrecision(precision)
+	if m.frozen == nil {
+		m.frozen = make(map[string]*InferenceModel)
+	}
+	m.frozen[precision] = im
+	return im
+}
+
+// precisionScores holds per-position comparisons of one precision against
+// the float64 reference.
+type precisionScores struct {
+	nll   []float64 // -log p(target)
+	kl    []float64 // KL(float64 || this precision)
+	agree []bool    // same top-1 prediction as float64
+}
+
+// scorePrecision compares one precision's next-token distributions
+// (batchLogits) with the float64 reference, position by position. Both come
+// from ForwardBatch on the same inputs.
+func scorePrecision(refLogits, batchLogits [][][]float64, targets [][]int) precisionScores {
+	var sc precisionScores
+	for b, logits := range batchLogits {
+		for t := range logits {
+			p := softmaxData(refLogits[b][t])
+			q := softmaxData(logits[t])
+			target := targets[b][t]
+			sc.nll = append(sc.nll, -math.Log(q[target]))
+			sc.kl = append(sc.kl, klDivergence(p, q))
+			sc.agree = append(sc.agree, argmax(p) == argmax(q))
+		}
+	}
+	return sc
+}
+
+// klDivergence is sum p*log(p/q), in nats.
+func klDivergence(p, q []float64) float64 {
+	kl := 0.0
+	for i := range p {
+		if p[i] > 0 {
+			kl += p[i] * math.Log(p[i]/q[i])
+		}
+	}
+	return math.Max(kl, 0)
+}
+
+// quantizationSequences encodes docs for scoring, each capped at
+// block_size positions.
+func quantizationSequences(im *InferenceModel, docs []string) (inputs, targets [][]int) {
+	for _, doc := range docs {
+		tokens := encodeDoc(doc, im.Chars, im.BOS)
+		n := len(tokens) - 1
+		if n > im.Config.BlockSize {
+			n = im.Config.BlockSize
+		}
+		if n <= 0 {
+			continue
+		}
+		inputs = append(inputs, tokens[:n])
+		targets = append(targets, tokens[1:n+1])
+	}
+	return inputs, targets
+}
+
+// compareQuantization scores float64, float32 and int8 exports of im on
+// docs. text, when non-empty, is also reported token by token.
+func compareQuantization(im *InferenceModel, valueBytes int, docs []string, text []int) (QuantizationResponse, error) {
+	inputs, targets := quantizationSequences(im, docs)
+	resp := QuantizationResponse{Scheme: QuantizationScheme, Docs: len(inputs), ValueGraphBytes: valueBytes}
+	if text != nil {
+		inputs = append(inputs, text[:len(text)-1])
+		targets = append(targets, text[1:])
+	}
+
+	var refLoss float64
+	refLogits, err := im.ForwardBatch(inputs)
+	if err != nil {
+		return QuantizationResponse{}, err
+	}
+	textScores := map[string]precisionScores{}
+	for _, precision := range []string{PrecisionFloat64, PrecisionFloat32, PrecisionInt8} {
+		f, _ := im.Freeze(precision)
+		logits := refLogits
+		if precision != PrecisionFloat64 {
+			if logits, err = f.Inference().ForwardBatch(inputs); err != nil {
+				return QuantizationResponse{}, err
+			}
+		}
+		sc := scorePrecision(refLogits, logits, targets)
+
+		// Aggregate over docs only; the text's positions come last.
+		n := len(sc.nll)
+		if text != nil {
+			n -= len(text) - 1
+			textScores[precision] = precisionScores{nll: sc.nll[n:], kl: sc.kl[n:], agree: sc.agree[n:]}
+		}
+		report := PrecisionReport{Precision: precision, Bytes: f.Bytes()}
+		agree := 0
+		for i := 0; i < n; i++ {
+			report.Loss += sc.nll[i]
+			report.MeanKL += sc.kl[i]
+			report.MaxKL = math.Max(report.MaxKL, sc.kl[i])
+			if sc.agree[i] {
+				agree++
+			}
+		}
+		if n > 0 {
+			report.Loss /= float64(n)
+			report.MeanKL /= float64(n)
+			report.TopAgreement = float64(agree) / float64(n)
+		}
+		report.Perplexity = math.Exp(report.Loss)
+		if precision == PrecisionFloat64 {
+			refLoss = report.Loss
+		}
+		report.PerplexityDiff = report.Perplexity - math.Exp(refLoss)
+		resp.Tokens = n
+		resp.Precisions = append(resp.Precisions, report)
+	}
+
+	for pos := 0; text != nil && pos < len(text)-1; pos++ {
+		resp.Text = append(resp.Text, QuantizationToken{
+			Position:    pos,
+			Token:       tokenLabel(text[pos], im.BOS, im.Chars),
+			Target:      tokenLabel(text[pos+1], im.BOS, im.Chars),
+			KLFloat32:   textScores[PrecisionFloat32].kl[pos],
+			KLInt8:      textScores[PrecisionInt8].kl[pos],
+			LossFloat64: textScores[PrecisionFloat64].nll[pos],
+			LossFloat32: textScores[PrecisionFloat32].nll[pos],
+			LossInt8:    textScores[PrecisionInt8].nll[pos],
+		})
+	}
+	return resp, nil
+}
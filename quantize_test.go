@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestInferenceAtCachesUntilUpdate(t *testing.T) {
+	m := newTestModel(t, Config{})
+	int8Model := m.inferenceAt(PrecisionInt8)
+	if m.inferenceAt(PrecisionInt8) != int8Model {
+		t.Fatal("expected the int8 export to be reused")
+	}
+	if m.inferenceAt(PrecisionFloat32) == int8Model {
+		t.Fatal("float32 and int8 share one cached export")
+	}
+	m.Update()
+	if m.inferenceAt(PrecisionInt8) == int8Model {
+		t.Fatal("Update should drop the cached exports")
+	}
+}
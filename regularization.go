@@ -0,0 +1,43 @@
+package main
+
+import "math/rand"
+
+// dropout randomly zeroes activations during training: each one is dropped
+// with probability rate and survivors are scaled by 1/(1-rate), so the
+// expected value stays the same and the model cannot rely on any single
+// feature.
+//
+// A nil *dropout means "evaluation mode": nothing is dropped. Only
+// batchLoss creates one; generation and scoring never do.
+type dropout struct {
+	rate float64
+	rng  *rand.Rand
+}
+
+// newDropout returns a dropout helper drawing masks from rng, or nil when
+// rate is zero. Each training example gets its own seeded rng, so masks do
+// not depend on which goroutine runs the example.
+func newDropout(rate float64, rng *rand.Rand) *dropout {
+	if rate <= 0 {
+		return nil
+	}
+	return &dropout{rate: rate, rng: rng}
+}
+
+// apply returns x with dropout applied (x itself when d is nil).
+func (d *dropout) apply(x []*Value) []*Value {
+	if d == nil {
+		return x
+	}
+	keep := NewValue(1 / (1 - d.rate))
+	zero := NewValue(0)
+	out := make([]*Value, len(x))
+	for i, xi := range x {
+		if d.rng.Float64() < d.rate {
+			out[i] = xi.Mul(zero)
+		} else {
+			out[i] = xi.Mul(keep)
+		}
+	}
+	return out
+}
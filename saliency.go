@@ -0,0 +1,70 @@
+package main
+
+import "math"
+
+// saliency runs tokens[:len-1] through the graph path and backpropagates
+// log p(target) at the last position to every position's input embedding.
+// The gradient shows how sensitive log p is to each position; gradient x
+// input estimates (to first order) how much the actual input contributed.
+//
+// If target is negative, the model's top prediction is used. m should be a
+// cloned copy of the parameters, so the real model's gradients (and any
+// training in progress) are never touched.
+func saliency(m *Model, tokens []int, target int) (SaliencyResponse, error) {
+	cache := m.NewKVCache()
+	inputSite := hookSite{Name: "input"}
+	hooks := make([]*forwardHooks, len(tokens)-1)
+	var logits []*Value
+	for pos := range hooks {
+		hooks[pos] = &forwardHooks{leaves: map[hookSite][]*Value{inputSite: nil}}
+		var err error
+		if logits, err = m.forward(tokens[pos], pos, cache, nil, hooks[pos]); err != nil {
+			return SaliencyResponse{}, err
+		}
+	}
+	probs := m.Softmax(logits)
+	if target < 0 {
+		target = 0
+		for i, p := range probs {
+			if p.Data > probs[target].Data {
+				target = i
+			}
+		}
+	}
+	logProb := probs[target].Log()
+	logProb.Backward()
+
+	resp := SaliencyResponse{
+		Target:     tokenLabel(target, m.BOS, m.Chars),
+		TargetProb: probs[target].Data,
+		LogProb:    logProb.Data,
+		Positions:  make([]SaliencyPosition, len(hooks)),
+	}
+	for pos, h := range hooks {
+		tokEmb := m.State["wte"][tokens[pos]]
+		var posEmb []float64
+		switch m.Config.positionEncoding() {
+		case PositionLearned:
+			for _, v := range m.State["wpe"][pos] {
+				posEmb = append(posEmb, v.Data)
+			}
+		case PositionSinusoidal:
+			posEmb = sinusoidalEncoding(pos, m.Config.NEmpd)
+		}
+
+		sp := SaliencyPosition{Position: pos, Token: tokenLabel(tokens[pos], m.BOS, m.Chars)}
+		sumSq := 0.0
+		for i, leaf := range h.leaves[inputSite] {
+			g := leaf.Grad
+			sumSq += g * g
+			sp.GradXInput += g * leaf.Data
+			sp.GradXToken += g * tokEmb[i].Data
+			if posEmb != nil {
+				sp.GradXPosition += g * posEmb[i]
+			}
+		}
+		sp.GradNorm = math.Sqrt(sumSq)
+		resp.Positions[pos] = sp
+	}
+	return resp, nil
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // Server owns HTTP handlers and shared application state.
@@ -15,22 +21,47 @@ import (
 // - Model is "ML math + parameters."
 // - Server is "request handling + lifecycle/state wiring."
 type Server struct {
-	mu    sync.RWMutex
-	model *Model
-	docs  []string
+	mu      sync.RWMutex
+	model   *Model
+	docs    []string
+	valDocs []string
+	draft   *Model // optional draft model for speculative decoding
+
+	metrics      *Metrics
+	maxBodyBytes int64
+
+	// Optional persistence (see persist.go).
+	store               *Store
+	saveMu              sync.Mutex
+	lastSavedModel      *Model
+	lastSavedSteps      int
+	lastSavedDraft      *Model
+	lastSavedDraftSteps int
 }
 
 // NewServer creates an empty API server.
 func NewServer() *Server {
-	return &Server{}
+	return &Server{metrics: NewMetrics()}
 }
 
 // RegisterRoutes attaches all endpoints to the provided mux.
 func (s *Server) RegisterRoutes(mux *http.ServeMux, webRoot fs.FS) {
-	mux.HandleFunc("/api/init", s.handleInit)
-	mux.HandleFunc("/api/train", s.handleTrain)
-	mux.HandleFunc("/api/generate", s.handleGenerate)
-	mux.HandleFunc("/api/generate_trace", s.handleGenerateTrace)
+	mux.HandleFunc("/api/init", s.metrics.instrument("handleInit", s.handleInit))
+	mux.HandleFunc("/api/train", s.metrics.instrument("handleTrain", s.handleTrain))
+	mux.HandleFunc("/api/generate", s.metrics.instrument("handleGenerate", s.handleGenerate))
+	mux.HandleFunc("/api/generate_trace", s.metrics.instrument("handleGenerateTrace", s.handleGenerateTrace))
+	mux.HandleFunc("/api/history", s.handleHistory)
+	mux.HandleFunc("/api/model", s.handleModel)
+	mux.HandleFunc("/api/inspect/embeddings", s.handleInspectEmbeddings)
+	mux.HandleFunc("/api/inspect/weights", s.handleInspectWeights)
+	mux.HandleFunc("/api/inspect/activations", s.handleInspectActivations)
+	mux.HandleFunc("/api/inspect/logit_lens", s.handleInspectLogitLens)
+	mux.HandleFunc("/api/inspect/ablate", s.handleInspectAblate)
+	mux.HandleFunc("/api/inspect/patch", s.handleInspectPatch)
+	mux.HandleFunc("/api/inspect/saliency", s.handleInspectSaliency)
+	mux.HandleFunc("/api/inspect/kv_cache", s.handleInspectKVCache)
+	mux.HandleFunc("/api/inspect/quantization", s.handleInspectQuantization)
+	mux.HandleFunc("/metrics", s.handleMetrics)
 	mux.Handle("/", http.FileServer(http.FS(webRoot)))
 }
 
@@ -41,12 +72,71 @@ func (s *Server) snapshot() (*Model, []string) {
 	return s.model, append([]string(nil), s.docs...)
 }
 
+// validationDocs returns the held-out docs used for validation loss.
+func (s *Server) validationDocs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.valDocs...)
+}
+
 // setModel swaps active model/docs atomically with exclusive lock.
-func (s *Server) setModel(model *Model, docs []string) {
+func (s *Server) setModel(model *Model, docs, valDocs []string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.model = model
 	s.docs = append([]string(nil), docs...)
+	s.valDocs = append([]string(nil), valDocs...)
+	if s.draft != nil && !sameVocab(s.draft, model) {
+		s.draft = nil
+	}
+}
+
+// setDraft replaces the draft model.
+func (s *Server) setDraft(draft *Model) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draft = draft
+}
+
+// draftModel returns the draft model (nil if none).
+func (s *Server) draftModel() *Model {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.draft
+}
+
+// draftInference snapshots the draft model for speculative decoding with
+// model. The draft is locked only while its weights are copied.
+func (s *Server) draftInference(model *Model, handler string) (*InferenceModel, error) {
+	draft := s.draftModel()
+	if draft == nil {
+		return nil, errors.New("draft_tokens needs a draft model (POST /api/init with target \"draft\")")
+	}
+	if !sameVocab(draft, model) {
+		return nil, errors.New("draft model vocabulary does not match the main model")
+	}
+	s.lockModel(draft, handler)
+	defer draft.mu.Unlock()
+	return draft.Inference(), nil
+}
+
+func sameVocab(a, b *Model) bool {
+	if len(a.Chars) != len(b.Chars) {
+		return false
+	}
+	for i := range a.Chars {
+		if a.Chars[i] != b.Chars[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lockModel acquires model.mu and records how long the handler waited for it.
+func (s *Server) lockModel(model *Model, handler string) {
+	start := time.Now()
+	model.mu.Lock()
+	s.metrics.observeLockWait(handler, time.Since(start))
 }
 
 // writeJSON is a helper to consistently send JSON responses.
@@ -56,28 +146,78 @@ func writeJSON(w http.ResponseWriter, status int, payload any) {
 	_ = json.NewEncoder(w).Encode(payload)
 }
 
+// SetMaxBodyBytes caps the size of every JSON request body (0 = unlimited).
+func (s *Server) SetMaxBodyBytes(n int64) {
+	s.maxBodyBytes = n
+}
+
+// decodeJSON decodes a required JSON body, enforcing the body size limit.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	if s.maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	}
+	return json.NewDecoder(r.Body).Decode(dst)
+}
+
 // decodeOptionalJSON decodes JSON when body is present.
 // Empty bodies are treated as "use defaults" rather than errors.
-func decodeOptionalJSON(r *http.Request, dst any) error {
+func (s *Server) decodeOptionalJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	if r.Body == nil {
 		return nil
 	}
-	err := json.NewDecoder(r.Body).Decode(dst)
+	err := s.decodeJSON(w, r, dst)
 	if err == io.EOF {
 		return nil
 	}
 	return err
 }
 
+// decodeError reports a body decoding failure with the right status code.
+func decodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
 func (s *Server) handleInit(w http.ResponseWriter, r *http.Request) {
 	var req InitRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if err := req.Config.Validate(); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	switch req.Target {
+	case "", "main":
+	case "draft":
+		main, _ := s.snapshot()
+		if main == nil {
+			http.Error(w, "Initialize the main model before its draft", http.StatusBadRequest)
+			return
+		}
+		draft := newModelWithVocab(req.Config, main.Chars)
+		s.setDraft(draft)
+		writeJSON(w, http.StatusOK, map[string]any{"status": "initialized", "target": "draft", "params": len(draft.Params)})
+		return
+	default:
+		http.Error(w, fmt.Sprintf("unknown target %q (use main or draft)", req.Target), http.StatusBadRequest)
+		return
+	}
 
-	model := NewModel(req.Config, req.Docs)
-	s.setModel(model, req.Docs)
+	if req.ValidationSplit < 0 || req.ValidationSplit >= 1 {
+		http.Error(w, "validation_split must be in [0, 1)", http.StatusBadRequest)
+		return
+	}
+	docs, valDocs := splitValidation(req.Docs, req.ValidationDocs, req.ValidationSplit)
+
+	// The vocabulary covers validation docs too, so their characters are known.
+	model := NewModel(req.Config, append(append([]string(nil), docs...), valDocs...))
+	s.setModel(model, docs, valDocs)
 
 	// Keep response shape compatible with existing frontend behavior.
 	w.Header().Set("Content-Type", "application/json")
@@ -96,15 +236,23 @@ func (s *Server) handleTrain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Lock model during forward/backward/update to avoid concurrent mutation.
-	model.mu.Lock()
-	defer model.mu.Unlock()
-
 	req := TrainRequest{}
-	if err := decodeOptionalJSON(r, &req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := s.decodeOptionalJSON(w, r, &req); err != nil {
+		decodeError(w, err)
 		return
 	}
+	switch req.Target {
+	case "", "main":
+	case "draft":
+		if model = s.draftModel(); model == nil {
+			http.Error(w, "Draft model not initialized", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown target %q (use main or draft)", req.Target), http.StatusBadRequest)
+		return
+	}
+
 	stepsPerCall := req.StepsPerCall
 	if stepsPerCall <= 0 {
 		stepsPerCall = 1
@@ -113,61 +261,159 @@ func (s *Server) handleTrain(w http.ResponseWriter, r *http.Request) {
 	if batchSize <= 0 {
 		batchSize = 6
 	}
+	if req.Workers < 0 || req.ValEvery < 0 || req.EvalDocs < 0 {
+		http.Error(w, "workers, val_every and eval_docs must not be negative", http.StatusBadRequest)
+		return
+	}
+	valEvery := req.ValEvery
+	if valEvery == 0 {
+		valEvery = 1
+	}
+	evalDocs := req.EvalDocs
+	if evalDocs == 0 {
+		evalDocs = defaultEvalDocs
+	}
+	workers := trainWorkers(req.Workers, batchSize)
+	seed := req.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+
+	// Lock model during forward/backward/update to avoid concurrent mutation.
+	s.lockModel(model, "handleTrain")
+	before := model.Steps
+	start := time.Now()
+	resp, err := TrainBatchedSteps(model, docs, stepsPerCall, batchSize, workers, rand.New(rand.NewSource(seed)))
+	if err != nil {
+		model.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Seed, resp.Workers = seed, workers
+	s.metrics.observeTraining(stepsPerCall, time.Since(start), resp.Loss, resp.GraphNodes)
+
+	// Evaluate only when this call crossed a multiple of val_every, on a
+	// snapshot, so other requests can use the model meanwhile.
+	valDocs := s.validationDocs()
+	if len(valDocs) == 0 || model.Steps/valEvery == before/valEvery {
+		model.mu.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	im := model.Inference()
+	model.mu.Unlock()
 
-	resp, err := TrainBatchedSteps(model, docs, stepsPerCall, batchSize)
+	if resp.TrainEvalLoss, err = evalLoss(im, capDocs(docs, evalDocs)); err == nil {
+		resp.ValLoss, err = evalLoss(im, capDocs(valDocs, evalDocs))
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	model.mu.Lock()
+	for i := len(model.History) - 1; i >= 0; i-- {
+		if model.History[i].Step == resp.Step {
+			model.History[i].ValLoss = resp.ValLoss
+			break
+		}
+	}
+	model.mu.Unlock()
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// defaultEvalDocs is how many training and validation docs /api/train
+// scores when eval_docs is not set.
+const defaultEvalDocs = 200
+
+// capDocs returns at most n docs, spread evenly over docs so a sorted list
+// is still sampled from start to end.
+func capDocs(docs []string, n int) []string {
+	if len(docs) <= n {
+		return docs
+	}
+	out := make([]string, n)
+	for i := range out {
+		out[i] = docs[i*len(docs)/n]
+	}
+	return out
+}
+
 func (s *Server) handleGenerate(w http.ResponseWriter, r *http.Request) {
-	model, _ := s.snapshot()
+	model, docs := s.snapshot()
 	if model == nil {
 		http.Error(w, "Model not initialized", http.StatusBadRequest)
 		return
 	}
 
-	model.mu.Lock()
+	s.lockModel(model, "handleGenerate")
 	defer model.mu.Unlock()
 
 	req := GenerateRequest{}
-	if err := decodeOptionalJSON(r, &req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := s.decodeOptionalJSON(w, r, &req); err != nil {
+		decodeError(w, err)
 		return
 	}
-	opts := req.Options
-	if opts.Temperature <= 0 {
-		opts.Temperature = 0.7
+	opts, hooks, draft, err := s.prepareGeneration(model, docs, req.Options, "handleGenerate")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if opts.TopK <= 0 {
-		opts.TopK = 5
+
+	var text string
+	if draft != nil {
+		var trace GenerateTraceResponse
+		trace, err = SpeculativeSample(model, draft, opts, hooks)
+		text = trace.Text
+	} else {
+		text, err = GenerateSample(model, opts, hooks)
 	}
-	if opts.MinLen <= 0 {
-		opts.MinLen = 3
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	text := GenerateSample(model, opts)
 	writeJSON(w, http.StatusOK, map[string]string{"text": text})
 }
 
 func (s *Server) handleGenerateTrace(w http.ResponseWriter, r *http.Request) {
-	model, _ := s.snapshot()
+	model, docs := s.snapshot()
 	if model == nil {
 		http.Error(w, "Model not initialized", http.StatusBadRequest)
 		return
 	}
 
-	model.mu.Lock()
+	s.lockModel(model, "handleGenerateTrace")
 	defer model.mu.Unlock()
 
 	req := GenerateRequest{}
-	if err := decodeOptionalJSON(r, &req); err != nil {
+	if err := s.decodeOptionalJSON(w, r, &req); err != nil {
+		decodeError(w, err)
+		return
+	}
+	opts, hooks, draft, err := s.prepareGeneration(model, docs, req.Options, "handleGenerateTrace")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var trace GenerateTraceResponse
+	if draft != nil {
+		trace, err = SpeculativeSample(model, draft, opts, hooks)
+	} else {
+		trace, err = GenerateSampleWithTrace(model, opts, hooks)
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	opts := req.Options
+	writeJSON(w, http.StatusOK, trace)
+}
+
+// prepareGeneration fills the generate handlers' defaults and validates
+// opts: precision, ablations, draft options and constraints. It returns the
+// ablation hooks and, when opts.DraftTokens > 0, the draft model.
+//
+// Callers must hold model.mu; handler names the caller for lock metrics.
+func (s *Server) prepareGeneration(model *Model, docs []string, opts GenerateOptions, handler string) (GenerateOptions, *forwardHooks, *InferenceModel, error) {
 	if opts.Temperature <= 0 {
 		opts.Temperature = 0.7
 	}
@@ -178,5 +424,146 @@ func (s *Server) handleGenerateTrace(w http.ResponseWriter, r *http.Request) {
 		opts.MinLen = 3
 	}
 
-	writeJSON(w, http.StatusOK, GenerateSampleWithTrace(model, opts))
+	if err := checkPrecision(opts.Precision); err != nil {
+		return opts, nil, nil, err
+	}
+	hooks, err := ablationHooks(model, opts.Ablations, docs)
+	if err != nil {
+		return opts, nil, nil, err
+	}
+	var draft *InferenceModel
+	if opts.DraftTokens > 0 {
+		if err := checkDraftOptions(opts); err != nil {
+			return opts, nil, nil, err
+		}
+		if draft, err = s.draftInference(model, handler); err != nil {
+			return opts, nil, nil, err
+		}
+	}
+	limit := generationLimit(model.Config, opts.MaxLen)
+	if draft != nil {
+		limit = speculativeLimit(model, draft, opts.MaxLen)
+	}
+	if _, err := newConstraint(model, opts, limit); err != nil {
+		return opts, nil, nil, err
+	}
+	return opts, hooks, draft, nil
+}
+
+// handleHistory serves GET /api/history: the model's per-step training log.
+//
+// Query parameters:
+// - format=json (default) or csv
+// - max_points=N downsamples to at most N points (0 = everything)
+// - since=S keeps only steps after S
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	model, docs := s.snapshot()
+	if model == nil {
+		http.Error(w, "Model not initialized", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	maxPoints, err := queryInt(query.Get("max_points"), 0)
+	if err != nil {
+		http.Error(w, "invalid max_points", http.StatusBadRequest)
+		return
+	}
+	since, err := queryInt(query.Get("since"), 0)
+	if err != nil {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+
+	s.lockModel(model, "handleHistory")
+	records := model.History
+	for len(records) > 0 && records[0].Step <= since {
+		records = records[1:]
+	}
+	resp := HistoryResponse{
+		Config: model.Config,
+		Params: len(model.Params),
+		Docs:   docs,
+		Total:  len(records),
+		Points: downsampleHistory(records, maxPoints),
+	}
+	model.mu.Unlock()
+	resp.Downsampled = len(resp.Points) < resp.Total
+
+	switch query.Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, resp)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"step", "loss", "learning_rate", "grad_norm", "batch_size", "wall_time", "duration_ms", "val_loss"})
+		for _, p := range resp.Points {
+			_ = cw.Write([]string{
+				strconv.Itoa(p.Step),
+				formatFloat(p.Loss),
+				formatFloat(p.LearningRate),
+				formatFloat(p.GradNorm),
+				strconv.Itoa(p.BatchSize),
+				strconv.FormatFloat(p.WallTime, 'f', 3, 64),
+				formatFloat(p.DurationMs),
+				optionalFloat(p.ValLoss),
+			})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+	}
+}
+
+// splitValidation separates training docs from validation docs.
+//
+// Explicit validation docs are used as given; otherwise a random
+// fraction of docs is held out (always leaving at least one for training).
+func splitValidation(docs, explicit []string, fraction float64) ([]string, []string) {
+	if len(explicit) > 0 || fraction <= 0 {
+		return docs, explicit
+	}
+	held := int(math.Round(fraction * float64(len(docs))))
+	if held >= len(docs) {
+		held = len(docs) - 1
+	}
+	if held <= 0 {
+		return docs, nil
+	}
+	train := make([]string, 0, len(docs)-held)
+	val := make([]string, 0, held)
+	for i, idx := range rand.Perm(len(docs)) {
+		if i < held {
+			val = append(val, docs[idx])
+		} else {
+			train = append(train, docs[idx])
+		}
+	}
+	return train, val
+}
+
+// optionalFloat formats v for CSV, leaving the cell empty when v is unset (zero).
+func optionalFloat(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return formatFloat(v)
+}
+
+// queryInt parses an optional integer query parameter.
+func queryInt(raw string, fallback int) (int, error) {
+	if raw == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(raw)
+}
+
+// handleMetrics serves GET /metrics in Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	paramCount := 0
+	if model, _ := s.snapshot(); model != nil {
+		paramCount = len(model.Params)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.writePrometheus(w, paramCount)
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// maxDraftTokens caps GenerateOptions.DraftTokens.
+const maxDraftTokens = 16
+
+// checkDraftOptions validates the speculative-decoding options.
+func checkDraftOptions(opts GenerateOptions) error {
+	if opts.DraftTokens > maxDraftTokens {
+		return fmt.Errorf("draft_tokens must be at most %d", maxDraftTokens)
+	}
+	if opts.KVWindow > 0 {
+		return errors.New("kv_window cannot be combined with draft_tokens")
+	}
+	return nil
+}
+
+// SpeculativeSample generates like GenerateSampleWithTrace, but with draft
+// proposing opts.DraftTokens characters per round. Each step's Draft field
+// records the accept/reject decision behind it.
+//
+// The target scores the proposals one position at a time through its cache
+// and keeps each with probability min(1, p/q) (p = target, q = draft). At the
+// first rejection it draws a replacement from residualProbs and drops the
+// rest; if all are kept, it samples one bonus character. Every character thus
+// follows exactly the target's distribution. Verification is not batched, so
+// on this CPU model the rounds show the algorithm rather than save time.
+//
+// draft must share model's vocabulary. opts.KVWindow is not supported:
+// rolling back a sliding window would lose entries the target still needs.
+// The error is an invalid constraint option or a forward-pass error.
+func SpeculativeSample(model *Model, draft *InferenceModel, opts GenerateOptions, hooks *forwardHooks) (GenerateTraceResponse, error) {
+	opts = samplingConfig(opts, model.VocabSize)
+	limit := speculativeLimit(model, draft, opts.MaxLen)
+	im := model.inferenceAt(opts.Precision)
+	cache := im.NewKVCache()
+	draftCache := draft.NewKVCache()
+	bos := model.BOS
+	label := func(id int) string { return tokenLabel(id, bos, model.Chars) }
+
+	tokens := []int{bos} // tokens[pos] is the input read at pos
+	sample := []string{}
+	steps := []TraceStep{}
+	stats := &SpeculativeStats{DraftTokens: opts.DraftTokens}
+	stopReason := "Reached block size limit"
+	if limit != model.Config.BlockSize {
+		stopReason = fmt.Sprintf("Reached max length limit (%d)", limit)
+	}
+	constraint, err := newConstraint(model, opts, limit)
+	if err != nil {
+		return GenerateTraceResponse{}, err
+	}
+	state := 0
+	counts := make([]int, model.VocabSize)
+	probsFor := func(logits []float64, sampleLen int, allowed []bool) ([]float64, []float64) {
+		return toProbVector(logits, opts, bos, sampleLen < opts.MinLen, allowed)
+	}
+
+	for done := false; !done && len(tokens)-1 < limit; {
+		pos := len(tokens) - 1
+		k := opts.DraftTokens
+		if k > limit-1-pos {
+			k = limit - 1 - pos
+		}
+		stats.Rounds++
+
+		// The draft may be one token behind after a fully accepted round.
+		for draftCache.Next() < pos {
+			if _, err := draft.forward(tokens[draftCache.Next()], draftCache.Next(), draftCache, nil); err != nil {
+				return GenerateTraceResponse{}, err
+			}
+		}
+
+		// 1. The draft proposes up to k tokens, one at a time. Constraint
+		// masks follow the proposals, and both models use the same masks.
+		proposed := []int{}
+		q := [][]float64{}
+		allowed := [][]bool{}
+		reasons := [][]string{}
+		countsAt := [][]int{}
+		addMask := func(st, sampleLen int, c []int) {
+			a, r := constraint.mask(st, sampleLen)
+			allowed, reasons = append(allowed, a), append(reasons, r)
+			countsAt = append(countsAt, c)
+		}
+		addMask(state, len(sample), counts)
+		st := state
+		in := tokens[pos]
+		for i := 0; i < k; i++ {
+			draftLogits, err := draft.forward(in, pos+i, draftCache, nil)
+			if err != nil {
+				return GenerateTraceResponse{}, err
+			}
+			_, qi := probsFor(applyPenalties(draftLogits, opts, countsAt[i]), len(sample)+i, allowed[i])
+			x, _, _, _, _ := sampleFromProbVector(qi, bos)
+			proposed = append(proposed, x)
+			q = append(q, qi)
+			if x == bos {
+				break // nothing follows <END>
+			}
+			in = x
+			st = constraint.next(st, x)
+			c := append([]int(nil), countsAt[i]...)
+			c[x]++
+			addMask(st, len(sample)+i+1, c)
+		}
+		k = len(proposed)
+		stats.Proposed += k
+
+		// 2. The target reads the current token and every proposal, one
+		// forward step each, giving its distribution at all k+1 positions
+		// (k if the last proposal is <END>, which is never read).
+		raw := make([][]float64, k+1)
+		p := make([][]float64, k+1)
+		modelLogits := make([][]float64, k+1)
+		logits := make([][]float64, k+1)
+		in = tokens[pos]
+		for i := 0; i < len(allowed); i++ {
+			var err error
+			if modelLogits[i], err = im.forward(in, pos+i, cache, hooks); err != nil {
+				return GenerateTraceResponse{}, err
+			}
+			logits[i] = applyPenalties(modelLogits[i], opts, countsAt[i])
+			raw[i], p[i] = probsFor(logits[i], len(sample)+i, allowed[i])
+			if i < k {
+				in = proposed[i]
+			}
+		}
+
+		// 3. Accept or reject proposals left to right.
+		emit := func(i int, tokenID int, step TraceStep) {
+			topK := withPenaltyLogits(topKCandidates(raw[i], p[i], model.Chars, bos, 5), modelLogits[i], logits[i])
+			step.Position = pos + i
+			step.Context = strings.Join(sample, "")
+			step.TopK = topK
+			step.ChosenChar = label(tokenID)
+			step.ChosenProb = p[i][tokenID]
+			step.ChosenRank = candidateRank(topK, tokenID, len(p[i]))
+			step.Masked, step.MaskedProb = maskedCandidates(raw[i], reasons[i], model.Chars, bos, 5)
+			step.Reason += maskedReason(step.Masked, step.MaskedProb)
+			steps = append(steps, step)
+			if tokenID == bos {
+				stopReason = "Model selected <END> token"
+				done = true
+				return
+			}
+			sample = append(sample, model.Chars[tokenID])
+			tokens = append(tokens, tokenID)
+			state = constraint.next(state, tokenID)
+			counts[tokenID]++
+		}
+		rejected := false
+		for i := 0; i < k && !done && !rejected; i++ {
+			x := proposed[i]
+			acceptProb := math.Min(1, p[i][x]/q[i][x])
+			u := rand.Float64()
+			decision := &DraftDecision{
+				Round:      stats.Rounds,
+				Proposed:   label(x),
+				DraftProb:  q[i][x],
+				TargetProb: p[i][x],
+				AcceptProb: acceptProb,
+				AcceptU:    u,
+			}
+			if u < acceptProb {
+				stats.Accepted++
+				decision.Outcome = "accepted"
+				emit(i, x, TraceStep{RandomU: u, Draft: decision, Reason: fmt.Sprintf(
+					"Draft proposed '%s' (q=%.4f); target gives p=%.4f. Accepted because draw %.4f < min(1, p/q) = %.4f.",
+					label(x), q[i][x], p[i][x], u, acceptProb,
+				)})
+				continue
+			}
+			rejected = true
+			decision.Outcome = "rejected"
+			y, r, cumBefore, cumAfter, _ := sampleFromProbVector(residualProbs(p[i], q[i]), bos)
+			emit(i, y, TraceStep{RandomU: r, CumBefore: cumBefore, CumAfter: cumAfter, Draft: decision, Reason: fmt.Sprintf(
+				"Draft proposed '%s' (q=%.4f); target gives p=%.4f. Rejected because draw %.4f >= min(1, p/q) = %.4f, so '%s' was resampled from max(0, p - q) (draw %.4f in [%.4f, %.4f)).",
+				label(x), q[i][x], p[i][x], u, acceptProb, label(y), r, cumBefore, cumAfter,
+			)})
+		}
+		if !done && !rejected {
+			y, r, cumBefore, cumAfter, _ := sampleFromProbVector(p[k], bos)
+			emit(k, y, TraceStep{RandomU: r, CumBefore: cumBefore, CumAfter: cumAfter,
+				Draft: &DraftDecision{Round: stats.Rounds, Outcome: "bonus"},
+				Reason: fmt.Sprintf(
+					"All %d draft proposals accepted, so the target's own distribution gave bonus token '%s' (draw %.4f in [%.4f, %.4f)).",
+					k, label(y), r, cumBefore, cumAfter,
+				),
+			})
+		}
+
+		// 4. Forget cache entries for thrown-away proposals.
+		next := len(tokens) - 1
+		_ = cache.Rollback(next)
+		if draftCache.Next() > next {
+			_ = draftCache.Rollback(next)
+		}
+		for i := len(steps) - 1; i >= 0 && steps[i].Draft.Round == stats.Rounds; i-- {
+			steps[i].CacheLen, steps[i].CacheBytes = cache.Len(), cache.Bytes()
+		}
+	}
+
+	if stats.Proposed > 0 {
+		stats.AcceptanceRate = float64(stats.Accepted) / float64(stats.Proposed)
+	}
+	stats.TokensPerPass = float64(len(steps)) / float64(stats.Rounds)
+	return GenerateTraceResponse{
+		Text:        strings.Join(sample, ""),
+		Steps:       steps,
+		StopReason:  stopReason,
+		Speculative: stats,
+	}, nil
+}
+
+// speculativeLimit is the generation length both models can handle.
+func speculativeLimit(model *Model, draft *InferenceModel, maxLen int) int {
+	limit := generationLimit(model.Config, maxLen)
+	if draftLimit := generationLimit(draft.Config, maxLen); draftLimit < limit {
+		limit = draftLimit
+	}
+	return limit
+}
+
+// residualProbs is max(0, p - q), renormalized: where the target wants more
+// probability than the draft gave. It falls back to p if nothing is left.
+func residualProbs(p, q []float64) []float64 {
+	out := make([]float64, len(p))
+	sum := 0.0
+	for i := range p {
+		out[i] = math.Max(0, p[i]-q[i])
+		sum += out[i]
+	}
+	if sum == 0 {
+		return p
+	}
+	for i := range out {
+		out[i] /= sum
+	}
+	return out
+}
+
+// candidateRank is tokenID's 1-based rank among topK, or vocabSize if it is
+// not listed.
+func candidateRank(topK []TraceCandidate, tokenID, vocabSize int) int {
+	for rank, cand := range topK {
+		if cand.TokenID == tokenID {
+			return rank + 1
+		}
+	}
+	return vocabSize
+}
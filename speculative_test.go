@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// sampleFrequencies draws n samples and returns how often each text came out.
+func sampleFrequencies(t *testing.T, n int, sample func() (string, error)) map[string]float64 {
+	t.Helper()
+	freq := map[string]float64{}
+	for i := 0; i < n; i++ {
+		text, err := sample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		freq[text] += 1 / float64(n)
+	}
+	return freq
+}
+
+// totalVariation is half the L1 distance between two distributions.
+func totalVariation(a, b map[string]float64) float64 {
+	d := 0.0
+	for k, v := range a {
+		d += math.Abs(v - b[k])
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			d += v
+		}
+	}
+	return d / 2
+}
+
+func TestSpeculativeMatchesPlainSampling(t *testing.T) {
+	rand.Seed(1)
+	m := newTestModel(t, Config{})
+	draft := newTestModel(t, Config{NEmpd: 8, NHead: 2, NLayer: 1, BlockSize: 8}).Inference()
+	opts := GenerateOptions{Temperature: 1, MaxLen: 2, DraftTokens: 2}
+	const n = 20000
+
+	plain := sampleFrequencies(t, n, func() (string, error) {
+		return GenerateSample(m, opts, nil)
+	})
+	accepted, proposed := 0, 0
+	speculative := sampleFrequencies(t, n, func() (string, error) {
+		trace, err := SpeculativeSample(m, draft, opts, nil)
+		accepted += trace.Speculative.Accepted
+		proposed += trace.Speculative.Proposed
+		return trace.Text, err
+	})
+	if accepted == 0 || accepted == proposed {
+		t.Fatalf("accepted %d of %d proposals; the test needs both outcomes", accepted, proposed)
+	}
+	if d := totalVariation(plain, speculative); d > 0.03 {
+		t.Fatalf("speculative and plain sampling differ by total variation %.4f", d)
+	}
+}
+
+func TestResidualProbs(t *testing.T) {
+	for _, c := range []struct{ p, q, want []float64 }{
+		{p: []float64{0.5, 0.3, 0.2}, q: []float64{0.2, 0.6, 0.2}, want: []float64{1, 0, 0}},
+		{p: []float64{0.4, 0.4, 0.2}, q: []float64{0.1, 0.3, 0.6}, want: []float64{0.75, 0.25, 0}},
+		{p: []float64{0.4, 0.6}, q: []float64{0.4, 0.6}, want: []float64{0.4, 0.6}},
+	} {
+		got := residualProbs(c.p, c.q)
+		for i := range c.want {
+			if math.Abs(got[i]-c.want[i]) > 1e-12 {
+				t.Fatalf("residualProbs(%v, %v) = %v, want %v", c.p, c.q, got, c.want)
+			}
+		}
+	}
+}
+
+// TestAcceptRejectGivesTarget checks the rule SpeculativeSample applies to
+// one proposal: accept x ~ q with probability min(1, p/q), otherwise draw from
+// residualProbs. The chance of ending on each token must be exactly p.
+func TestAcceptRejectGivesTarget(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []float64 {
+		out := make([]float64, n)
+		for i := range out {
+			out[i] = rng.Float64()
+		}
+		return softmaxData(out)
+	}
+	for trial := 0; trial < 100; trial++ {
+		p, q := random(6), random(6)
+		accepted := make([]float64, len(p))
+		rejectProb := 1.0
+		for x := range q {
+			accepted[x] = q[x] * math.Min(1, p[x]/q[x])
+			rejectProb -= accepted[x]
+		}
+		residual := residualProbs(p, q)
+		for x := range p {
+			if got := accepted[x] + rejectProb*residual[x]; math.Abs(got-p[x]) > 1e-12 {
+				t.Fatalf("trial %d token %d: accept/reject gives %v, target %v", trial, x, got, p[x])
+			}
+		}
+	}
+}
+
+func TestSpeculativeTraceDecisions(t *testing.T) {
+	rand.Seed(2)
+	m := newTestModel(t, Config{})
+	draft := newTestModel(t, Config{NEmpd: 8, NHead: 2, NLayer: 1, BlockSize: 8}).Inference()
+	opts := GenerateOptions{Temperature: 1, DraftTokens: 3}
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		trace, err := SpeculativeSample(m, draft, opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range trace.Steps {
+			d := step.Draft
+			seen[d.Outcome] = true
+			switch d.Outcome {
+			case "accepted":
+				if d.AcceptU >= d.AcceptProb || step.ChosenChar != d.Proposed {
+					t.Fatalf("accepted step is inconsistent: %+v, chose %q", d, step.ChosenChar)
+				}
+			case "rejected":
+				if d.AcceptU < d.AcceptProb || d.AcceptProb >= 1 {
+					t.Fatalf("rejected step is inconsistent: %+v", d)
+				}
+			}
+		}
+	}
+	for _, outcome := range []string{"accepted", "rejected", "bonus"} {
+		if !seen[outcome] {
+			t.Errorf("no %s step in 200 samples", outcome)
+		}
+	}
+
+	// A draft identical to the target is always accepted.
+	trace, err := SpeculativeSample(m, m.Inference(), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Speculative.Accepted != trace.Speculative.Proposed {
+		t.Fatalf("identical draft: accepted %d of %d", trace.Speculative.Accepted, trace.Speculative.Proposed)
+	}
+}
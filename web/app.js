@@ -241,6 +241,10 @@
     const data = await res.json();
     state.paramCount = data.params || 0;
     state.isInitialized = true;
+    if (data.docs && data.docs.length > 0) {
+      state.docs = data.docs;
+      renderDocs();
+    }
     state.trainProgress = [];
     state.recentPredictions = [];
     el.paramCount.textContent = String(state.paramCount);
@@ -255,6 +259,35 @@
     drawChart();
   }
 
+  // restoreSession reloads the loss chart and docs list from the server-side
+  // training log, so a page refresh does not wipe a model that is already
+  // being trained.
+  // Resolves to true when an existing trained model was found.
+  async function restoreSession() {
+    const res = await fetch("/api/history?max_points=50");
+    if (!res.ok) {
+      return false;
+    }
+    const data = await res.json();
+    if (!data.points || data.points.length === 0) {
+      return false;
+    }
+    state.paramCount = data.params || 0;
+    state.isInitialized = true;
+    if (data.docs && data.docs.length > 0) {
+      state.docs = data.docs;
+      renderDocs();
+    }
+    state.trainProgress = data.points.map(function (p) {
+      return { step: p.step, loss: p.loss, targetProb: null };
+    });
+    el.paramCount.textContent = String(state.paramCount);
+    const last = state.trainProgress[state.trainProgress.length - 1];
+    el.lossLabel.textContent = "Current Loss: " + last.loss.toFixed(4);
+    drawChart();
+    return true;
+  }
+
   function renderDocs() {
     el.docsList.innerHTML = "";
     state.docs.forEach(function (doc, index) {
@@ -321,7 +354,11 @@
     ctx.stroke();
 
     // Overlay confidence as subtle dots.
+    // Points restored from /api/history have no confidence and get no dot.
     state.trainProgress.forEach(function (p, i) {
+      if (p.targetProb === null) {
+        return;
+      }
       const x = (i / 49) * w;
       const y = h - (p.loss / maxLoss) * h;
       const prob = Number(p.targetProb || 0);
@@ -384,7 +421,8 @@
         }
         el.tokenTape.textContent = state.recentPredictions.join(" ");
         const currentLoss = state.trainProgress[state.trainProgress.length - 1].loss;
-        el.lossLabel.textContent = "Current Loss: " + currentLoss.toFixed(4);
+        el.lossLabel.textContent = "Current Loss: " + currentLoss.toFixed(4) +
+          (data.val_loss ? "  |  Validation Loss: " + Number(data.val_loss).toFixed(4) : "");
         drawChart();
         await new Promise(function (resolve) {
           setTimeout(resolve, 50);
@@ -581,5 +619,9 @@
   setActiveTab("theory");
   setTraceEnabled(false);
   showExplanation("Vocabulary");
-  initModel().catch(console.error);
+  restoreSession().then(function (restored) {
+    if (!restored) {
+      return initModel();
+    }
+  }).catch(console.error);
 })();
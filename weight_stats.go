@@ -0,0 +1,148 @@
+package main
+
+import "math"
+
+const (
+	defaultHistogramBins     = 20
+	defaultNearZeroThreshold = 1e-3
+
+	// trackWeightsEvery is how often (in optimizer steps) a snapshot is kept.
+	trackWeightsEvery = 10
+	// maxWeightSnapshots caps the stored timeline; older entries are thinned.
+	maxWeightSnapshots = 200
+)
+
+// weightStats summarizes every named matrix: how its weights spread around
+// zero, how hard the gradient pushes on it, and how much one step changes it
+// (the update/weight ratio). Callers must hold m.mu.
+//
+// A tied lm_head is skipped because it is the same matrix as wte.
+func (m *Model) weightStats(bins int, nearZero float64) []MatrixStats {
+	index := make(map[*Value]int, len(m.Params))
+	for i, p := range m.Params {
+		index[p] = i
+	}
+
+	stats := []MatrixStats{}
+	for _, name := range m.matrixNames() {
+		if name == "lm_head" && m.Config.TieEmbeddings {
+			continue
+		}
+		var weights, grads, updates []float64
+		for _, row := range m.State[name] {
+			for _, v := range row {
+				i := index[v]
+				weights = append(weights, v.Data)
+				grads = append(grads, m.lastGrad[i])
+				updates = append(updates, m.adamUpdate(i))
+			}
+		}
+		stats = append(stats, matrixStats(name, weights, grads, updates, bins, nearZero))
+	}
+	return stats
+}
+
+// adamUpdate is the size of the Adam step last applied to Params[i],
+// rebuilt from the optimizer moments (which do not change between steps).
+func (m *Model) adamUpdate(i int) float64 {
+	if m.Steps == 0 {
+		return 0
+	}
+	mHat := m.AdamM[i] / (1 - math.Pow(adamBeta1, float64(m.Steps)))
+	vHat := m.AdamV[i] / (1 - math.Pow(adamBeta2, float64(m.Steps)))
+	return m.Config.LearningRate * mHat / (math.Sqrt(vHat) + adamEps)
+}
+
+func matrixStats(name string, weights, grads, updates []float64, bins int, nearZero float64) MatrixStats {
+	n := float64(len(weights))
+	st := MatrixStats{Name: name, Params: len(weights)}
+
+	wMean, wStd := meanStd(weights)
+	st.Mean, st.Std = wMean, wStd
+	st.Min, st.Max = math.Inf(1), math.Inf(-1)
+	weightSq, zeros := 0.0, 0
+	for _, w := range weights {
+		st.Min = math.Min(st.Min, w)
+		st.Max = math.Max(st.Max, w)
+		weightSq += w * w
+		if math.Abs(w) < nearZero {
+			zeros++
+		}
+	}
+	st.NearZero = float64(zeros) / n
+	st.Histogram = histogramOf(weights, st.Min, st.Max, bins)
+
+	st.GradMean, st.GradStd = meanStd(grads)
+	gradSq := 0.0
+	for _, g := range grads {
+		gradSq += g * g
+		st.GradMaxAbs = math.Max(st.GradMaxAbs, math.Abs(g))
+	}
+	st.GradNorm = math.Sqrt(gradSq)
+
+	updateSq := 0.0
+	for _, u := range updates {
+		updateSq += u * u
+	}
+	if weightSq > 0 {
+		st.UpdateRatio = math.Sqrt(updateSq / weightSq)
+	}
+	return st
+}
+
+func meanStd(xs []float64) (float64, float64) {
+	if len(xs) == 0 {
+		return 0, 0
+	}
+	mean := 0.0
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	variance := 0.0
+	for _, x := range xs {
+		variance += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(xs)))
+}
+
+// histogramOf buckets xs into bins equal-width bins over [lo, hi].
+func histogramOf(xs []float64, lo, hi float64, bins int) Histogram {
+	h := Histogram{Min: lo, Max: hi, Counts: make([]int, bins)}
+	width := (hi - lo) / float64(bins)
+	for _, x := range xs {
+		b := 0
+		if width > 0 {
+			b = int((x - lo) / width)
+		}
+		if b >= bins {
+			b = bins - 1 // x == hi lands in the last bin
+		}
+		h.Counts[b]++
+	}
+	return h
+}
+
+// trackWeights appends a snapshot every trackWeightsEvery steps (and on the
+// first step) so the UI can animate how distributions move during training.
+//
+// When the timeline is full, every other old snapshot is dropped, so memory
+// stays bounded and long runs still cover the whole history.
+func (m *Model) trackWeights() {
+	if m.Steps != 1 && m.Steps%trackWeightsEvery != 0 {
+		return
+	}
+	m.weights = append(m.weights, WeightSnapshot{
+		Step:     m.Steps,
+		Matrices: m.weightStats(defaultHistogramBins, defaultNearZeroThreshold),
+	})
+	if len(m.weights) > maxWeightSnapshots {
+		thinned := m.weights[:0]
+		for i, snap := range m.weights {
+			if i%2 == 0 || i == len(m.weights)-1 {
+				thinned = append(thinned, snap)
+			}
+		}
+		m.weights = thinned
+	}
+}